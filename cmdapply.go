@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+var applyCommand = &Command{
+	UsageLine: "apply [-f] [-work] [module...]",
+	Short:     "hack modules and apply the patches saved in the main module",
+	Long: `
+The apply command hacks each module that has patches saved in the
+main module and applies the patches to it, so a set of changes to
+dependencies can be kept under version control with the main
+module and reproduced anywhere.
+
+Patches are kept in the directory .gohack/patches/<module> alongside
+the main module's go.mod file, in files with a .patch suffix, which
+are applied in lexical order. Each file holds a unified diff as
+printed by "gohack diff", so a patch can be saved with, for example:
+
+	mkdir -p .gohack/patches/example.com/foo
+	gohack diff example.com/foo > .gohack/patches/example.com/foo/0001-fix.patch
+
+If module arguments are given, only the patches for those modules
+are applied.
+
+Unless $GOHACK is set, the modules are hacked in the directory
+.gohack/mod/<module> alongside the main module's go.mod file, so the
+replace directives refer to that rather than to a directory in the
+user's home directory. That directory can be recreated at any time by
+running apply, so it should be ignored by the main module's VCS (for
+example, by adding .gohack/mod to .gitignore).
+
+The modules are hacked without VCS information, as by "gohack get -u",
+at the version currently required, so after the required version of a
+module changes, running apply again brings its directory up to date
+and applies its patches to the new version, reporting any patch that
+no longer applies and leaving the directory as it was.
+
+A directory that holds any changes other than those made by
+its patches will not be updated unless the -f flag is specified.
+The -work flag is as for the get command.
+`[1:],
+}
+
+func init() {
+	applyCommand.Run = cmdApply // break init cycle
+}
+
+var (
+	applyForce = applyCommand.Flag.Bool("f", false, "discard changes that aren't in the patches")
+	applyWork  = applyCommand.Flag.Bool("work", false, "add replace directives to the go.work file instead of go.mod")
+)
+
+// patchDir holds the directory, relative to the main module's
+// directory, that holds the patches applied by gohack apply.
+const patchDir = ".gohack/patches"
+
+// applyHackDir holds the directory, relative to the main module's
+// directory, that gohack apply hacks modules in when $GOHACK
+// isn't set.
+const applyHackDir = ".gohack/mod"
+
+func cmdApply(_ *Command, args []string) int {
+	if err := cmdApply1(args); err != nil {
+		errorf("%v", err)
+	}
+	return 0
+}
+
+func cmdApply1(modules []string) error {
+	// Keep the hacks with the main module, so that the
+	// replace directives work wherever it's checked out.
+	defaultHackDir = applyHackDir
+	root := filepath.Join(fileDir(mainModFile), filepath.FromSlash(patchDir))
+	queue, err := readPatchQueue(root)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if len(modules) == 0 {
+		if len(queue) == 0 {
+			return errors.Newf("no patches found in %s", relPath(root))
+		}
+		for mpath := range queue {
+			modules = append(modules, mpath)
+		}
+		sort.Strings(modules)
+	}
+	var args, paths []string
+	for _, mpath := range modules {
+		files := queue[mpath]
+		if len(files) == 0 {
+			errorf("no patches found for %s", mpath)
+			continue
+		}
+		if err := checkOnlyPatched(mpath, files, *applyForce); err != nil {
+			errorf("cannot apply patches to %s: %v", mpath, err)
+			continue
+		}
+		args = append(args, mpath)
+		paths = append(paths, files...)
+	}
+	if len(args) == 0 {
+		return errors.Newf("no patches applied")
+	}
+	// Any existing directories hold nothing but the changes
+	// made by the patches, which will be applied again, unless
+	// -f was specified, so they can be updated regardless.
+	*getUpdate = true
+	*getForce = true
+	*getWork = *applyWork
+	getPatches = paths
+	return runGet1(args)
+}
+
+// readPatchQueue returns the names of the patch files for each
+// module in the patch directory root, in the order they should be
+// applied.
+func readPatchQueue(root string) (map[string][]string, error) {
+	queue := make(map[string][]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".patch") {
+			return nil
+		}
+		dir, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		mpath := filepath.ToSlash(dir)
+		// Walk visits the files in lexical order.
+		queue[mpath] = append(queue[mpath], path)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return queue, nil
+}
+
+// checkOnlyPatched checks that the directory that the module with the
+// given path will be hacked in is either absent, clean or holds only the
+// changes made by the given patch files to the version it was copied
+// from. If force is true, it only checks that the directory was created
+// by gohack without VCS information.
+func checkOnlyPatched(mpath string, patchFiles []string, force bool) error {
+	var dir string
+	if f, r := findHackReplace(mpath); r != nil {
+		dir = replaceDirPath(fileDir(f), r.New.Path)
+	} else {
+		d, _, err := moduleDir(mpath)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		dir = d
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	wantHash, version, err := readHashFile(dir)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return errors.Newf("%q was not created by gohack get without -vcs", dir)
+		}
+		return errors.Wrap(err)
+	}
+	if force {
+		return nil
+	}
+	gotHash, err := hashDir(dir, mpath)
+	if err != nil {
+		return errors.Notef(err, nil, "cannot hash %q", dir)
+	}
+	if gotHash == wantHash {
+		return nil
+	}
+	notPatched := errors.Newf("%q has changes that aren't in the patches; not overwriting", dir)
+	if version == "" {
+		return notPatched
+	}
+	src, err := pristineModule(&listModule{
+		Path:    mpath,
+		Version: version,
+	}, downloadModule)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	patches, err := readPatches(patchFiles)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	byModule, err := patchesByModule(patches, []string{mpath})
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	same, err := isPatchedCopy(mpath, dir, src.Dir, byModule[mpath])
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if !same {
+		return notPatched
+	}
+	return nil
+}
+
+// isPatchedCopy reports whether the hack directory dir holds exactly
+// the module source in srcDir with the given patches applied.
+func isPatchedCopy(mpath, dir, srcDir string, patches []modulePatch) (bool, error) {
+	patched, _, err := patchedFiles(srcDir, patches)
+	if err != nil {
+		// The patches don't apply to the source, so
+		// they can't have been used to make dir.
+		return false, nil
+	}
+	srcFiles, err := hackFiles(srcDir, mpath)
+	if err != nil {
+		return false, errors.Wrap(err)
+	}
+	want := make(map[string]bool)
+	for _, f := range srcFiles {
+		want[f] = true
+	}
+	for f, data := range patched {
+		want[f] = data != nil
+	}
+	files, err := hackFiles(dir, mpath)
+	if err != nil {
+		return false, errors.Wrap(err)
+	}
+	n := 0
+	for _, f := range files {
+		if !want[f] {
+			return false, nil
+		}
+		n++
+		wantData, ok := patched[f]
+		if !ok {
+			same, err := sameContents(filepath.Join(dir, filepath.FromSlash(f)), filepath.Join(srcDir, filepath.FromSlash(f)))
+			if err != nil {
+				return false, errors.Wrap(err)
+			}
+			if !same {
+				return false, nil
+			}
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(f)))
+		if err != nil {
+			return false, errors.Wrap(err)
+		}
+		if !bytes.Equal(data, wantData) {
+			return false, nil
+		}
+	}
+	for _, ok := range want {
+		if ok {
+			n--
+		}
+	}
+	return n == 0, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+var diffCommand = &Command{
+	UsageLine: "diff [module...]",
+	Short:     "print the changes made to a module",
+	Long: `
+The diff command prints a unified diff between the pristine source
+of each of the given modules and its gohack directory. With no
+arguments, the changes to all the modules currently replaced by
+directories are printed.
+
+Only directories created without the -vcs flag can be compared; use the
+version control system to see the changes in a VCS directory. The same
+files are compared as are used to decide whether the directory is clean.
+
+File names in the diff have the form a/<module>/<file> and
+b/<module>/<file>, so the output can be saved and applied again with
+"gohack get -patch" (see "gohack help get"), or with "patch -p1" in
+the gohack root directory. Changes to binary files can't be
+represented in a unified diff, so the diff only mentions them
+and the command fails.
+`[1:],
+}
+
+func init() {
+	diffCommand.Run = cmdDiff // break init cycle
+}
+
+func cmdDiff(_ *Command, args []string) int {
+	if err := cmdDiff1(args); err != nil {
+		errorf("%v", err)
+	}
+	return 0
+}
+
+func cmdDiff1(modules []string) error {
+	explicit := len(modules) > 0
+	if !explicit {
+		modules = hackedModules()
+	}
+	for _, mpath := range modules {
+		f, r := findHackReplace(mpath)
+		if r == nil {
+			errorf("%s is not currently replaced by a directory", mpath)
+			continue
+		}
+		dir := replaceDirPath(fileDir(f), r.New.Path)
+		if _, err := os.Stat(filepath.Join(dir, hashFile)); err != nil {
+			if !os.IsNotExist(err) {
+				errorf("cannot diff %s: %v", mpath, err)
+			} else if explicit {
+				errorf("cannot diff %s: %q was not created by gohack get without -vcs", mpath, dir)
+			}
+			continue
+		}
+		srcDir, err := pristineDirForHack(mpath)
+		if err != nil {
+			errorf("cannot diff %s: %v", mpath, err)
+			continue
+		}
+		diff, binary, err := diffHack(mpath, dir, srcDir)
+		if err != nil {
+			errorf("cannot diff %s: %v", mpath, err)
+			continue
+		}
+		if _, err := os.Stdout.Write(diff); err != nil {
+			return errors.Wrap(err)
+		}
+		for _, name := range binary {
+			errorf("cannot diff %s: binary file %s changed; the change can't be applied from the diff", mpath, name)
+		}
+	}
+	return nil
+}
+
+// diffHack returns a unified diff between the pristine source
+// of the module with the given path in srcDir and its
+// hack directory dir. It also returns the names of any changed
+// binary files, which the diff only mentions.
+func diffHack(mpath, dir, srcDir string) (diff []byte, binary []string, err error) {
+	files, err := hackFiles(dir, mpath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err)
+	}
+	srcFiles, err := hackFiles(srcDir, mpath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err)
+	}
+	all := make(map[string]bool)
+	for _, f := range append(files, srcFiles...) {
+		all[f] = true
+	}
+	names := make([]string, 0, len(all))
+	for f := range all {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldName, old, err := readDiffFile(srcDir, "a/"+mpath, name)
+		if err != nil {
+			return nil, nil, errors.Wrap(err)
+		}
+		newName, new, err := readDiffFile(dir, "b/"+mpath, name)
+		if err != nil {
+			return nil, nil, errors.Wrap(err)
+		}
+		if !bytes.Equal(old, new) && (isBinary(old) || isBinary(new)) {
+			binary = append(binary, name)
+		}
+		diff = append(diff, unifiedDiff(oldName, newName, old, new)...)
+	}
+	return diff, binary, nil
+}
+
+// readDiffFile reads the file with the given slash-separated name
+// in dir and returns the name to use for it in a diff, which
+// has the given prefix, or "/dev/null" if the file doesn't exist.
+func readDiffFile(dir, prefix, name string) (string, []byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "/dev/null", nil, nil
+		}
+		return "", nil, errors.Wrap(err)
+	}
+	return prefix + "/" + name, data, nil
+}
+
+// modulePatch holds the changes to a file in a module
+// from a patch file.
+type modulePatch struct {
+	// source holds the name of the patch file.
+	source string
+	// file holds the slash-separated name of
+	// the file within the module.
+	file  string
+	patch *filePatch
+}
+
+// readPatches reads the unified diffs in the given files.
+// The first element of each file name is removed,
+// as for "patch -p1".
+func readPatches(paths []string) ([]modulePatch, error) {
+	var patches []modulePatch
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		fps, err := parsePatch(path, data)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		for _, fp := range fps {
+			name := fp.newName
+			if name == "/dev/null" {
+				name = fp.oldName
+			}
+			i := strings.Index(name, "/")
+			if i < 0 {
+				return nil, errors.Newf("%s: invalid file name %q", path, name)
+			}
+			patches = append(patches, modulePatch{
+				source: path,
+				file:   name[i+1:],
+				patch:  fp,
+			})
+		}
+	}
+	return patches, nil
+}
+
+// patchesByModule returns the patches that apply to each of the modules
+// with the given paths. The file name of each patch starts with
+// the path of the module it applies to, which is changed to be relative
+// to the module's directory.
+func patchesByModule(patches []modulePatch, mpaths []string) (map[string][]modulePatch, error) {
+	byModule := make(map[string][]modulePatch)
+	for _, p := range patches {
+		best := ""
+		for _, mpath := range mpaths {
+			if strings.HasPrefix(p.file, mpath+"/") && len(mpath) > len(best) {
+				best = mpath
+			}
+		}
+		if best == "" {
+			return nil, errors.Newf("%s: %s is not in any of the modules being got", p.source, p.file)
+		}
+		p.file = p.file[len(best)+1:]
+		byModule[best] = append(byModule[best], p)
+	}
+	return byModule, nil
+}
+
+// applyPatches applies the given patches to the module
+// directory dir. All the patches are checked before any
+// files are changed.
+func applyPatches(dir string, patches []modulePatch) error {
+	contents, files, err := patchedFiles(dir, patches)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		data := contents[file]
+		if data == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return errors.Wrap(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0666); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// patchedFiles returns the contents of the files in dir that are changed
+// by the given patches once they've been applied, keyed by slash-separated
+// file name, with nil contents for removed files. It also returns the
+// names of the changed files in the order they were first changed.
+func patchedFiles(dir string, patches []modulePatch) (map[string][]byte, []string, error) {
+	contents := make(map[string][]byte)
+	var files []string
+	for _, p := range patches {
+		data, ok := contents[p.file]
+		if !ok {
+			var err error
+			data, err = ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p.file)))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, nil, errors.Wrap(err)
+			}
+			files = append(files, p.file)
+		}
+		exists := data != nil
+		switch {
+		case p.patch.oldName == "/dev/null" && exists:
+			return nil, nil, errors.Newf("%s: cannot create %s: file already exists", p.source, p.file)
+		case p.patch.oldName != "/dev/null" && !exists:
+			return nil, nil, errors.Newf("%s: cannot patch %s: file does not exist", p.source, p.file)
+		}
+		data, err := p.patch.apply(data)
+		if err != nil {
+			return nil, nil, errors.Notef(err, nil, "%s: cannot patch %s", p.source, p.file)
+		}
+		if p.patch.newName == "/dev/null" {
+			data = nil
+		} else if data == nil {
+			data = []byte{}
+		}
+		contents[p.file] = data
+	}
+	return contents, files, nil
+}
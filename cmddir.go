@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"text/template"
+
+	"github.com/rogpeppe/go-internal/module"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+var dirCommand = &Command{
+	UsageLine: "dir [-vcs] [-f format] [module...]",
+	Short:     "print the gohack directory for a module",
+	Long: `
+The dir command prints the gohack directory names for the given
+modules. If no modules are given, all the modules currently
+replaced by directories in the go.mod file are printed.
+
+Unlike the other subcommands, the modules don't need to be
+referenced by the current module.
+
+For each module, it prints the module path, the absolute
+directory path and the path as it would be used in a
+go.mod replace directive. The -f flag specifies
+an alternative format for each module, using the
+syntax of package template. The struct being passed
+to the template is:
+
+	type Dir struct {
+		Path    string // module path
+		Dir     string // absolute path to the module directory
+		ReplDir string // path used in the go.mod replace directive
+	}
+
+For example, to print only the absolute directory:
+
+	gohack dir -f '{{.Dir}}' example.com/foo/bar
+
+If the -vcs flag is provided, the directory to be used in VCS
+mode is printed. That can differ because a VCS checkout holds
+the module's whole repository, so a module with a major version
+suffix may be found at the root of the checkout rather than in
+the directory named by the suffix. The repository is found as
+for "gohack get -vcs", and once it has been cloned, the
+directory whose go.mod file declares the module is printed.
+Until then, the directory is printed as without -vcs, without
+needing to look up the repository.
+`[1:],
+}
+
+func init() {
+	dirCommand.Run = cmdDir // break init cycle
+}
+
+var (
+	dirVCS    = dirCommand.Flag.Bool("vcs", false, "print directories used in VCS mode")
+	dirFormat = dirCommand.Flag.String("f", "{{.Path}} {{.Dir}} {{.ReplDir}}", "output format")
+)
+
+// dirInfo holds the information printed by the dir command.
+type dirInfo struct {
+	Path    string
+	Dir     string
+	ReplDir string
+}
+
+func cmdDir(_ *Command, args []string) int {
+	if err := cmdDir1(args); err != nil {
+		errorf("%v", err)
+	}
+	return 0
+}
+
+func cmdDir1(modules []string) error {
+	tmpl, err := template.New("").Parse(*dirFormat + "\n")
+	if err != nil {
+		return errors.Notef(err, nil, "invalid format")
+	}
+	var dirs []dirInfo
+	if len(modules) == 0 {
+		for _, mpath := range hackedModules() {
+			f, r := findHackReplace(mpath)
+			dirs = append(dirs, dirInfo{
+				Path:    mpath,
+				Dir:     replaceDirPath(fileDir(f), r.New.Path),
+				ReplDir: r.New.Path,
+			})
+		}
+	}
+	for _, mpath := range modules {
+		if err := module.CheckPath(mpath); err != nil {
+			errorf("invalid module path %q: %v", mpath, err)
+			continue
+		}
+		dir, replDir, err := moduleDir(mpath)
+		if err == nil && *dirVCS {
+			dir, replDir, err = vcsModuleDir(mpath, dir, replDir)
+		}
+		if err != nil {
+			errorf("failed to determine target directory for %v: %v", mpath, err)
+			continue
+		}
+		dirs = append(dirs, dirInfo{
+			Path:    mpath,
+			Dir:     dir,
+			ReplDir: replDir,
+		})
+	}
+	for _, d := range dirs {
+		if err := tmpl.Execute(os.Stdout, d); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// vcsModuleDir returns the directory that the module with the given
+// path would be hacked in by get -vcs, and the path to use for it in a
+// replace directive, given the directory and path used in non-VCS mode.
+func vcsModuleDir(mpath, dir, replDir string) (string, string, error) {
+	if v, _ := findVCSRoot(dir, mpath); v == nil {
+		// The repository hasn't been cloned yet, so we can't
+		// tell where the module will be found. There's no need
+		// to resolve the repository, which might mean going to
+		// the network.
+		return dir, replDir, nil
+	}
+	// The checkout exists, so the repository is found
+	// locally without going to the network.
+	info, err := getVCSInfoForModule(&listModule{
+		Path: mpath,
+	}, dir, replDir)
+	if err != nil {
+		return "", "", errors.Wrap(err)
+	}
+	if err := findModuleDir(info); err != nil {
+		return "", "", errors.Wrap(err)
+	}
+	return info.dir, info.replDir, nil
+}
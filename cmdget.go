@@ -1,20 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"text/template"
 
 	"gopkg.in/errgo.v2/fmt/errors"
 
 	"github.com/rogpeppe/go-internal/modfile"
 	"github.com/rogpeppe/go-internal/module"
+	"github.com/rogpeppe/go-internal/semver"
 )
 
 var getCommand = &Command{
-	UsageLine: "get [-vcs] [-u] [-f] [module...]",
+	UsageLine: "get [-vcs] [-fork url] [-branch template] [-u] [-f] [-p n] [-depth n] [-filter filter] [-work] [-patch file] [-all-modules | -modules dirs] [-json] [module[@query]...]",
 	Short:     "start hacking a module",
 	Long: `
 The get command checks out Go module dependencies
@@ -28,21 +36,183 @@ source directory in $GOPATH/pkg/mod. If the -vcs
 flag is specified, it also checks out the version control information into that
 directory and updates it to the expected version. If the directory
 already exists, it will be updated in place.
+
+If the -fork flag is specified with -vcs, the repository is cloned
+from the given fork instead of the upstream repository, which is added
+as a remote named "upstream", so that versions that aren't in the fork
+can still be checked out. The URL may be a template in the syntax of
+package template, with the following struct passed to it:
+
+	type Fork struct {
+		Path string // module path
+		Root string // import path of the repository root
+		Base string // last element of Root
+		Repo string // URL of the upstream repository
+	}
+
+For example:
+
+	gohack get -vcs -fork 'git@github.com:ourorg/{{.Base}}.git' github.com/foo/bar
+
+The -fork flag has no effect on repositories that have already been cloned.
+
+In VCS mode, a branch is created at the required version and checked
+out, so that any commits made in the hack directory are not left on a
+detached head. In Mercurial, a bookmark is used instead. The -branch flag
+specifies the name of the branch as a template in the syntax of package
+template, with the following struct passed to it:
+
+	type Branch struct {
+		MainModule string // path of the main module
+		Path       string // module path
+		Version    string // module version being checked out
+	}
+
+It defaults to "gohack/{{.MainModule}}/{{.Version}}". If the branch
+already exists and holds the required version, it is checked out as is,
+keeping any commits on top of that version. Otherwise it is moved to the
+required version, unless that would lose commits that haven't been
+pushed, in which case get fails. If -branch is empty, the version is
+checked out without creating a branch.
+
+In VCS mode, the repository is found as the go get command does,
+unless it has already been cloned or $GOHACKREPOS says where it is.
+$GOHACKREPOS holds a comma-separated list of prefix=url entries,
+each of which specifies the repository for modules whose paths
+have that prefix. The URL may be preceded by the kind of VCS and
+a plus sign (for example hg+https://example.com/repo); otherwise
+git is assumed. Git, Mercurial (hg), Bazaar (bzr), Subversion (svn)
+and Fossil (fossil) repositories are supported. Subversion
+repositories are expected to use the standard layout, with version
+tags in the tags directory next to the trunk directory.
+Git repositories are handled by a built-in implementation of git
+if the git command isn't installed or the global -gogit flag
+is specified. The push command still needs the git command.
+
+Modules from the same repository, such as modules in subdirectories
+of it or other major versions of the same module, share a single
+checkout of the repository, so they can only be hacked at the same
+revision. Get fails rather than update a checkout to a revision that
+another module hacked there doesn't use; for example, when major
+versions are developed on separate branches, only one of them can be
+hacked at a time.
+
+For large git repositories, the -depth flag makes a shallow clone
+holding only the given number of revisions of history, and the -filter
+flag makes a partial clone that fetches objects only when they're
+needed, as for the git clone flags of the same names (for example,
+-filter blob:none). If a required version isn't in a shallow clone,
+gohack fetches its tag or deepens the history until it's there.
+The flags can only be used for git repositories. The built-in git
+implementation can't make partial clones and can only make shallow
+clones of tagged versions, because it can't deepen the history.
+
+If the -u flag is specified, modules that are already being
+hacked are updated in place to the version currently
+required by the main module. With no module arguments,
+all modules currently replaced by a directory that gohack
+created are updated. Only such directories, found inside the
+gohack directory or made by get without -vcs, are ever updated;
+other directory replacements, such as the user's own clones or
+directories in the main module, are left alone.
+A directory that has local changes will not be updated
+unless the -f flag is also specified. In VCS mode, revisions that
+haven't been pushed to a remote repository count as local changes.
+With -f, changes to files are discarded, and so are untracked files
+other than those that are ignored, but unpushed revisions are never
+lost: in git, if only a detached head refers to them, they're saved on
+a branch named gohack-backup/<revision> first, and a branch holding
+revisions that aren't in the required version is never moved (see
+above). Revisions kept only on gohack-backup branches don't count as
+unpushed, so they're removed along with the directory by "gohack rm".
+
+Instead of a module path, an argument may be the import path of
+a package, in which case the module containing the package is used,
+or a pattern that selects all the modules in use whose paths match it,
+where "..." matches any string (for example example.com/org/...).
+The pattern "all" selects all modules in use.
+
+A module argument may have a version query suffix of the form
+@query, as accepted by go get (for example @v1.2.3, @master or
+@<commit hash>), to hack that version of the module instead of the
+version currently required. In VCS mode, a query that isn't
+known to the go command is used as a VCS revision as is.
+
+By default, the replace directives are added to the main module's
+go.mod file. If the -work flag is specified, they are added to the
+go.work file instead, leaving go.mod untouched, so the
+hacks are less likely to be committed by accident. If there is no go.work
+file, one that uses the main module is created alongside go.mod.
+
+In a repository with several main modules, the -all-modules
+flag causes the replace directive to be added to the go.mod file of
+every main module in the repository that uses the module, each with
+its own relative path to the hack directory. The -modules flag does
+the same for a comma-separated list of root directories of other
+main modules. The status, undo and rm commands accept the same flags.
+
+Modules are fetched and copied concurrently. The -p flag
+specifies the number of modules that may be got at the same time;
+it defaults to the number of CPUs available.
+
+Each directory is locked while it's being updated so that several gohack
+commands can run at the same time. If another gohack process holds the
+lock, get waits for up to $GOHACKLOCKTIMEOUT (a duration such as
+"30s"; 5 minutes by default) for it to be released. A VCS checkout
+shared by several modules is locked as a whole. The lock files are
+kept in the .gohack-locks directory inside the gohack directory.
+
+The -patch flag specifies a file holding a unified diff, such as one
+printed by "gohack diff", to apply to the module directories once
+they've been got. It may be repeated to apply several files in turn.
+Each file name in the diff must have a leading directory element
+(such as "a/" or "b/") followed by the path of one of the modules
+being got and the name of the file within that module. Without -vcs,
+the patches are checked against the module source before the
+directory is written, so a module whose patches don't apply is
+left as it was.
+
+If the -json flag is specified, the result for each module is printed
+as a JSON object in the format described by "gohack help status",
+with any error for the module held in the Error field.
 `[1:],
 }
 
 func init() {
 	getCommand.Run = runGet // break init cycle
+	addJSONFlag(getCommand)
+	addModulesFlags(getCommand)
+	getCommand.Flag.Var(&getPatches, "patch", "apply the unified diff in `file` to the modules (may be repeated)")
 }
 
 var (
-	// TODO implement getUpdate so that we can use gohack -f without
-	// overwriting source code.
-	// getUpdate = getCommand.Flag.Bool("u", false, "update to current version")
-	getForce = getCommand.Flag.Bool("f", false, "force update to current version even if not clean")
-	getVCS   = getCommand.Flag.Bool("vcs", false, "get VCS information too")
+	getUpdate   = getCommand.Flag.Bool("u", false, "update to current version")
+	getForce    = getCommand.Flag.Bool("f", false, "force update to current version even if not clean")
+	getVCS      = getCommand.Flag.Bool("vcs", false, "get VCS information too")
+	getFork     = getCommand.Flag.String("fork", "", "clone from the fork with the given `URL` or URL template (with -vcs)")
+	getBranch   = getCommand.Flag.String("branch", "gohack/{{.MainModule}}/{{.Version}}", "name `template` of the branch to check out (with -vcs)")
+	getParallel = getCommand.Flag.Int("p", runtime.NumCPU(), "number of modules to get concurrently")
+	getWork     = getCommand.Flag.Bool("work", false, "add replace directives to the go.work file instead of go.mod")
+	getDepth    = getCommand.Flag.Int("depth", 0, "clone only the most recent `n` revisions of history (with -vcs)")
+	getFilter   = getCommand.Flag.String("filter", "", "make a partial git clone with the given object `filter` (with -vcs)")
+
+	// getPatches holds the files specified with -patch.
+	getPatches stringsFlag
 )
 
+// stringsFlag implements flag.Value by
+// accumulating the values of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
 func runGet(cmd *Command, args []string) int {
 	if err := runGet1(args); err != nil {
 		errorf("%v", err)
@@ -50,85 +220,615 @@ func runGet(cmd *Command, args []string) int {
 	return 0
 }
 
+var (
+	// forkTemplate holds the parsed -fork flag, if any.
+	forkTemplate *template.Template
+
+	// branchTemplate holds the parsed -branch flag, if any.
+	branchTemplate *template.Template
+)
+
 func runGet1(args []string) error {
+	if *getParallel < 1 {
+		return errors.Newf("-p must be at least 1")
+	}
+	if *getFork != "" {
+		if !*getVCS {
+			return errors.Newf("-fork requires -vcs")
+		}
+		tmpl, err := template.New("").Option("missingkey=error").Parse(*getFork)
+		if err != nil {
+			return errors.Notef(err, nil, "invalid -fork template")
+		}
+		forkTemplate = tmpl
+	}
+	if *getDepth < 0 {
+		return errors.Newf("-depth must not be negative")
+	}
+	if (*getDepth > 0 || *getFilter != "") && !*getVCS {
+		return errors.Newf("-depth and -filter require -vcs")
+	}
+	if *getBranch != "" {
+		tmpl, err := template.New("").Option("missingkey=error").Parse(*getBranch)
+		if err != nil {
+			return errors.Notef(err, nil, "invalid -branch template")
+		}
+		branchTemplate = tmpl
+	}
+	patches, err := readPatches(getPatches)
+	if err != nil {
+		return errors.Notef(err, nil, "cannot read patch")
+	}
+	if *getWork && workFile == nil {
+		if os.Getenv("GOWORK") == "off" {
+			return errors.Newf("cannot use -work when GOWORK=off")
+		}
+		f, err := newWorkFile(filepath.Join(fileDir(mainModFile), "go.work"))
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		workFile = f
+	}
 	if len(args) == 0 {
-		return errors.Newf("get requires at least one module argument")
+		if !*getUpdate {
+			return errors.Newf("get requires at least one module argument")
+		}
+		args = createdHacks()
+		if len(args) == 0 {
+			return errors.Newf("no modules are currently replaced by a directory created by gohack")
+		}
 	}
-	var repls []*modReplace
 	mods, err := listModules("all")
 	if err != nil {
 		// TODO this happens when a replacement directory has been removed.
 		// Perhaps we should be more resilient in that case?
 		return errors.Notef(err, nil, "cannot get module info")
 	}
-	for _, mpath := range args {
-		m := mods[mpath]
-		if m == nil {
-			errorf("module %q does not appear to be in use", mpath)
-			continue
+	// usedBy holds the modules used by each main module.
+	usedBy := []map[string]*listModule{mods}
+	if len(mainModFiles) > 1 {
+		all := make(map[string]*listModule)
+		for mpath, m := range mods {
+			all[mpath] = m
 		}
-		// Early check that we can replace the module, so we don't
-		// do all the work to check it out only to find we can't
-		// add the replace directive.
-		if err := checkCanReplace(mainModFile, mpath); err != nil {
-			errorf("%v", err)
-			continue
+		for _, f := range mainModFiles[1:] {
+			fmods, err := listModulesIn(fileDir(f), "all")
+			if err != nil {
+				return errors.Notef(err, nil, "cannot get module info for %s", relPath(f.Syntax.Name))
+			}
+			usedBy = append(usedBy, fmods)
+			for mpath, m := range fmods {
+				// Prefer the information from the current
+				// main module and from modules that use
+				// the module rather than defining it.
+				if all[mpath] == nil || all[mpath].Main && !m.Main {
+					all[mpath] = m
+				}
+			}
 		}
-		if m.Replace != nil && m.Replace.Path == m.Replace.Dir {
-			// TODO if -u flag specified, update to the current version instead of printing an error.
-			errorf("%q is already replaced by %q - are you already gohacking it?", mpath, m.Replace.Dir)
-			continue
+		mods = all
+	}
+	targets := expandModuleArgs(args, mods)
+	var mpaths []string
+	for _, t := range targets {
+		mpaths = append(mpaths, t.path)
+		version := t.query
+		if version == "" && mods[t.path] != nil {
+			version = mods[t.path].Version
 		}
-		var repl *modReplace
-		if *getVCS {
-			repl1, err := updateVCSDir(m)
-			if err != nil {
-				errorf("cannot update VCS dir for %s: %v", m.Path, err)
-				continue
+		getVersions[t.path] = version
+	}
+	modulePatches, err := patchesByModule(patches, mpaths)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	// Getting modules can involve lots of network access and
+	// copying, so do it concurrently, but keep the results in order
+	// so that the go.mod file and the output are deterministic.
+	got := make([]*modReplace, len(targets))
+	errs := make([]error, len(targets))
+	parallel(len(targets), *getParallel, func(i int) {
+		t := targets[i]
+		if t.err != nil {
+			errs[i] = t.err
+			return
+		}
+		files := hackFilesFor(t.path, usedBy)
+		got[i], errs[i] = getModule(mods[t.path], t.path, t.query, files, modulePatches[t.path])
+		if got[i] != nil {
+			got[i].files = files
+		}
+	})
+	var repls []*modReplace
+	results := make([]*hackStatus, 0, len(targets))
+	for i, t := range targets {
+		st := &hackStatus{
+			Path: t.path,
+		}
+		results = append(results, st)
+		if errs[i] != nil {
+			if err, ok := errors.Cause(errs[i]).(*patchError); ok {
+				failf(st, "%v", err)
+			} else {
+				failf(st, "%v", errs[i])
 			}
-			repl = repl1
-		} else {
-			repl1, err := updateFromLocalDir(m)
-			if err != nil {
-				errorf("cannot update %s from local cache: %v", m.Path, err)
+			continue
+		}
+		repl := got[i]
+		if ps := modulePatches[repl.modulePath]; len(ps) > 0 {
+			if err := applyPatches(repl.dir, ps); err != nil {
+				version := t.query
+				if version == "" {
+					version = mods[t.path].Version
+				}
+				failf(st, "cannot apply patches to %s@%s: %v", repl.modulePath, version, err)
 				continue
 			}
-			repl = repl1
+			progressf("patched %s\n", repl.modulePath)
 		}
 		// Automatically generate a go.mod file if one doesn't already exist,
 		// because otherwise the directory cannot be used as a module.
 		if err := ensureGoModFile(repl.modulePath, repl.dir); err != nil {
-			errorf("%v", err)
+			failf(st, "%v", err)
+			continue
 		}
 		repls = append(repls, repl)
 	}
 	if len(repls) == 0 {
+		if jsonOutput {
+			if err := printJSON(results); err != nil {
+				return errors.Wrap(err)
+			}
+		}
 		return errors.New("all modules failed; not replacing anything")
 	}
-	if err := replace(mainModFile, repls); err != nil {
+	changed, err := replace(repls)
+	if err != nil {
 		return errors.Notef(err, nil, "cannot replace")
 	}
-	if err := writeModFile(mainModFile); err != nil {
-		return errors.Wrap(err)
+	for _, f := range replaceFiles() {
+		if !changed[f] {
+			continue
+		}
+		if err := writeModFile(f); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	if !jsonOutput {
+		for _, info := range repls {
+			if len(mainModFiles) == 1 || *getWork {
+				fmt.Printf("%s => %s\n", info.modulePath, info.replDir)
+				continue
+			}
+			for _, f := range info.files {
+				replDir, _ := info.replDirFor(f)
+				fmt.Printf("%s: %s => %s\n", relPath(f.Syntax.Name), info.modulePath, replDir)
+			}
+		}
+		return nil
 	}
-	for _, info := range repls {
-		fmt.Printf("%s => %s\n", info.modulePath, info.replDir)
+	for i, st := range results {
+		if st.Error != nil {
+			continue
+		}
+		f, r := findHackReplace(st.Path)
+		st1, err := getHackStatus(f, r, mods[st.Path])
+		if err != nil {
+			failf(st, "cannot get status of %s: %v", st.Path, err)
+			continue
+		}
+		results[i] = st1
+	}
+	return printJSON(results)
+}
+
+// hackFilesFor returns the files that the replace directive for the
+// module with the given path should be added to. The usedBy argument
+// holds the modules used by each of mainModFiles.
+//
+// When operating on several main modules, that's the go.mod
+// file of each main module that uses the module.
+func hackFilesFor(mpath string, usedBy []map[string]*listModule) []*modfile.File {
+	if len(mainModFiles) == 1 || *getWork {
+		return []*modfile.File{hackFile()}
+	}
+	var files []*modfile.File
+	for i, f := range mainModFiles {
+		if m := usedBy[i][mpath]; m != nil && !m.Main {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// parallel calls f(i) for each i in [0, n), running at most
+// limit calls concurrently, and waits for them all to complete.
+func parallel(n, limit int, f func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// splitModuleQuery splits an argument of the form module[@query].
+func splitModuleQuery(arg string) (mpath, query string) {
+	if i := strings.Index(arg, "@"); i >= 0 {
+		return arg[:i], arg[i+1:]
+	}
+	return arg, ""
+}
+
+// moduleArg holds a module to be hacked, as resolved
+// from a command line argument.
+type moduleArg struct {
+	path  string
+	query string
+	// err holds an error if the argument could not be resolved.
+	err error
+}
+
+// expandModuleArgs resolves the arguments to the get command to the
+// modules that they refer to. An argument can be a module path, the
+// import path of a package inside a module, a pattern containing "..."
+// wildcards that matches module paths, or "all", which matches all modules
+// in use. Any argument may be followed by a version query (see
+// splitModuleQuery) which applies to all the modules it refers to.
+// Each module is only returned once.
+func expandModuleArgs(args []string, mods map[string]*listModule) []moduleArg {
+	var inUse []string
+	for _, m := range mods {
+		if !m.Main {
+			inUse = append(inUse, m.Path)
+		}
+	}
+	sort.Strings(inUse)
+	var targets []moduleArg
+	seen := make(map[string]bool)
+	add := func(mpath, query string) {
+		if !seen[mpath] {
+			seen[mpath] = true
+			targets = append(targets, moduleArg{
+				path:  mpath,
+				query: query,
+			})
+		}
+	}
+	for _, arg := range args {
+		pat, query := splitModuleQuery(arg)
+		if pat == "all" || strings.Contains(pat, "...") {
+			match := matchPattern(pat)
+			n := 0
+			for _, mpath := range inUse {
+				if match(mpath) {
+					add(mpath, query)
+					n++
+				}
+			}
+			if n == 0 {
+				targets = append(targets, moduleArg{
+					path: pat,
+					err:  errors.Newf("pattern %q matched no modules in use", pat),
+				})
+			}
+			continue
+		}
+		if mods[pat] == nil {
+			if mpath := moduleForPackage(pat, inUse); mpath != "" {
+				pat = mpath
+			}
+		}
+		add(pat, query)
+	}
+	return targets
+}
+
+// matchPattern returns a function that reports whether a module path
+// matches the given pattern, where "..." matches any string and "all"
+// matches everything. As with the go command, a pattern ending in "/..."
+// also matches the path without that suffix.
+func matchPattern(pattern string) func(string) bool {
+	if pattern == "all" {
+		return func(string) bool { return true }
+	}
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	reg := regexp.MustCompile(`^` + re + `$`)
+	return reg.MatchString
+}
+
+// moduleForPackage returns the path of the module in the given list
+// of module paths that contains the package with the given import path,
+// or "" if there is none. When several modules could contain
+// the package, the module with the longest path is chosen.
+func moduleForPackage(pkg string, mpaths []string) string {
+	best := ""
+	for _, mpath := range mpaths {
+		if !strings.HasPrefix(pkg, mpath+"/") || len(mpath) <= len(best) {
+			continue
+		}
+		// Don't treat a path that refers to a different major
+		// version of a module as a package inside it.
+		rest := pkg[len(mpath)+1:]
+		if elem := strings.SplitN(rest, "/", 2)[0]; majorVersionPat.MatchString(elem) {
+			continue
+		}
+		best = mpath
+	}
+	return best
+}
+
+var majorVersionPat = regexp.MustCompile(`^v[0-9]+$`)
+
+// getModule makes a hack directory for the module with the given path
+// and returns the replacement to be made for it in the given files.
+// The module m holds the go list information for the module, or nil
+// if the module is not in use. If query is non-empty, it specifies the
+// version to use instead of the version currently required.
+//
+// The patches will be applied to the directory once it's been made.
+// Without -vcs, getModule checks that they apply first, so that an
+// existing directory isn't overwritten when they don't; the error
+// then has a *patchError cause.
+func getModule(m *listModule, mpath, query string, files []*modfile.File, patches []modulePatch) (*modReplace, error) {
+	if m == nil {
+		return nil, errors.Newf("module %q does not appear to be in use", mpath)
+	}
+	if m.Main {
+		return nil, errors.Newf("cannot hack the main module %q", mpath)
+	}
+	if *getUpdate && m.Replace != nil && m.Replace.Version == "" {
+		// The module is already replaced by a directory,
+		// so update that directory in place.
+		repl, err := updateHack(m, query, patches)
+		if err != nil {
+			return nil, errors.Notef(err, isPatchError, "cannot update %s", m.Path)
+		}
+		return repl, nil
+	}
+	// Early check that we can replace the module, so we don't
+	// do all the work to check it out only to find we can't
+	// add the replace directive.
+	for _, f := range files {
+		if err := checkCanReplace(f, mpath); err != nil {
+			return nil, errors.Wrap(err)
+		}
+	}
+	if m.Replace != nil && m.Replace.Path == m.Replace.Dir {
+		return nil, errors.Newf("%q is already replaced by %q - are you already gohacking it?", mpath, m.Replace.Dir)
+	}
+	dir, replDir, err := moduleDir(m.Path)
+	if err != nil {
+		return nil, errors.Notef(err, nil, "failed to determine target directory for %v", m.Path)
+	}
+	if query != "" {
+		m1, err := moduleAtQuery(m, query, *getVCS)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		m = m1
+	}
+	if *getVCS {
+		repl, err := updateVCSDir(m, dir, replDir)
+		if err != nil {
+			return nil, errors.Notef(err, nil, "cannot update VCS dir for %s", m.Path)
+		}
+		return repl, nil
+	}
+	repl, err := updateFromLocalDir(m, dir, replDir, patches)
+	if err != nil {
+		return nil, errors.Notef(err, isPatchError, "cannot update %s from local cache", m.Path)
+	}
+	return repl, nil
+}
+
+// findDirReplace returns the replace directive in f that
+// replaces the module with the given path by a directory,
+// or nil if there is none.
+func findDirReplace(f *modfile.File, mpath string) *modfile.Replace {
+	for _, r := range f.Replace {
+		if r.Old.Path == mpath && r.Old.Version == "" && r.New.Version == "" {
+			return r
+		}
 	}
 	return nil
 }
 
-func updateFromLocalDir(m *listModule) (*modReplace, error) {
+// hackedModules returns the paths of all the modules
+// that are replaced by a directory in the go.mod file
+// or the go.work file.
+func hackedModules() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, f := range replaceFiles() {
+		for _, r := range f.Replace {
+			if r.Old.Version == "" && r.New.Version == "" && !seen[r.Old.Path] {
+				seen[r.Old.Path] = true
+				paths = append(paths, r.Old.Path)
+			}
+		}
+	}
+	return paths
+}
+
+// createdHacks returns the modules in hackedModules whose
+// replacement directories were created by gohack.
+func createdHacks() []string {
+	var paths []string
+	for _, mpath := range hackedModules() {
+		if dir, err := hackDirForModule(mpath); err == nil && isGohackDir(dir) {
+			paths = append(paths, mpath)
+		}
+	}
+	return paths
+}
+
+// isGohackDir reports whether the directory dir was created by
+// gohack: that is, whether it's inside the gohack directory or
+// holds the hash file written by get without -vcs. Other directory
+// replacements, such as the user's own clones or directories in the
+// main module, must never be updated or removed.
+func isGohackDir(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, hashFile)); err == nil {
+		return true
+	}
+	hackRoot, _, err := moduleDir("")
+	if err != nil {
+		return false
+	}
+	return dir != hackRoot && isWithinDir(dir, hackRoot) && !holdsMainModule(dir)
+}
+
+// moduleAtQuery returns information on the version of m selected
+// by the given query, which may be anything accepted by go get,
+// such as a version, a branch name or a commit hash.
+//
+// In non-VCS mode, the module is downloaded and the Dir field
+// of the result refers to its source. In VCS mode, if the query
+// cannot be resolved to a module version, it's assumed to be
+// a VCS revision and is used as the version as is.
+func moduleAtQuery(m *listModule, query string, vcsMode bool) (*listModule, error) {
+	if !vcsMode {
+		dm, err := downloadModule(m.Path, query)
+		if err != nil {
+			return nil, errors.Notef(err, nil, "cannot download %s@%s", m.Path, query)
+		}
+		return dm, nil
+	}
+	mods, err := listModules(m.Path + "@" + query)
+	if err == nil && mods[m.Path] != nil {
+		return &listModule{
+			Path:    m.Path,
+			Version: mods[m.Path].Version,
+		}, nil
+	}
+	if semver.IsValid(query) {
+		return nil, errors.Notef(err, nil, "cannot find %s@%s", m.Path, query)
+	}
+	return &listModule{
+		Path:    m.Path,
+		Version: query,
+	}, nil
+}
+
+// updateHack updates the existing directory replacement
+// for m in place to the version currently required by the main module,
+// or to the version selected by query if it's non-empty. The patches
+// are as for getModule.
+func updateHack(m *listModule, query string, patches []modulePatch) (*modReplace, error) {
+	dir, replDir := m.Replace.Dir, m.Replace.Path
+	if !isGohackDir(dir) {
+		return nil, errors.Newf("%q was not created by gohack; not updating it", dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, hashFile)); err == nil {
+		// There's a hash file, so it was created in non-VCS mode.
+		if *getVCS {
+			return nil, errors.Newf("%q was not created with -vcs; cannot update it in VCS mode", dir)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err)
+	} else if v, _ := findVCSRoot(dir, m.Path); v != nil {
+		if query != "" {
+			m1, err := moduleAtQuery(m, query, true)
+			if err != nil {
+				return nil, errors.Wrap(err)
+			}
+			m = m1
+		}
+		repl, err := updateVCSDir(m, dir, replDir)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		repl.alreadyReplaced = true
+		return repl, nil
+	} else if *getVCS {
+		return nil, errors.Newf("%q is not a VCS checkout; cannot update it in VCS mode", dir)
+	}
+	var src *listModule
+	var err error
+	if query != "" {
+		src, err = moduleAtQuery(m, query, false)
+	} else {
+		src, err = pristineModule(m, downloadModule)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	repl, err := updateFromLocalDir(src, dir, replDir, patches)
+	if err != nil {
+		return nil, errors.Note(err, isPatchError, "")
+	}
+	repl.alreadyReplaced = true
+	return repl, nil
+}
+
+// pristineModule returns information on the module source that a
+// non-VCS hack of m should contain. When the hack itself
+// replaced an earlier module replacement, that's the
+// source of the earlier replacement; otherwise it's the
+// currently required version of m. The fetch argument is used
+// to get the module source: downloadModule or cachedModule.
+func pristineModule(m *listModule, fetch func(path, version string) (*listModule, error)) (*listModule, error) {
+	src := module.Version{
+		Path:    m.Path,
+		Version: m.Version,
+	}
+	if _, r := findHackReplace(m.Path); r != nil && len(r.Syntax.Comments.Suffix) > 0 {
+		if prev := splitWasComment(r.Syntax.Comments.Suffix[0].Token); prev != nil && prev.New.Version != "" {
+			src = prev.New
+		}
+	}
+	dm, err := fetch(src.Path, src.Version)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	// The hack directory always holds the original module path,
+	// even when its contents come from another module.
+	return &listModule{
+		Path:    m.Path,
+		Version: m.Version,
+		Dir:     dm.Dir,
+	}, nil
+}
+
+// updateFromLocalDir updates destDir to hold a copy of the source
+// of m, checking first that the given patches apply to it.
+func updateFromLocalDir(m *listModule, destDir, replDir string, patches []modulePatch) (*modReplace, error) {
 	if m.Dir == "" {
 		return nil, errors.Newf("no local source code found")
 	}
+	if len(patches) > 0 {
+		// The patches are applied to the source in memory,
+		// so this leaves destDir alone if they don't apply.
+		if _, _, err := patchedFiles(m.Dir, patches); err != nil {
+			return nil, &patchError{
+				path:    m.Path,
+				version: m.Version,
+				err:     err,
+			}
+		}
+	}
 	srcHash, err := hashDir(m.Dir, m.Path)
 	if err != nil {
 		return nil, errors.Notef(err, nil, "cannot hash %q", m.Dir)
 	}
-	destDir, replDir, err := moduleDir(m.Path)
+	// Make sure that no other gohack process changes the
+	// directory between checking it and writing the hash file.
+	unlock, err := lockDir(destDir)
 	if err != nil {
-		return nil, errors.Notef(err, nil, "failed to determine target directory for %v", m.Path)
+		return nil, errors.Wrap(err)
 	}
+	defer unlock()
 	_, err = os.Stat(destDir)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, errors.Wrap(err)
@@ -157,7 +857,11 @@ func updateFromLocalDir(m *listModule) (*modReplace, error) {
 					return nil, errors.Wrap(err)
 				}
 				if destHash == srcHash {
-					// Everything is exactly as we want it already.
+					// Everything is exactly as we want it already,
+					// although the version might have changed.
+					if err := writeHashFile(destDir, srcHash, m.Version); err != nil {
+						return nil, errors.Wrap(err)
+					}
 					return repl, nil
 				}
 			}
@@ -170,14 +874,32 @@ func updateFromLocalDir(m *listModule) (*modReplace, error) {
 	}
 	// Write a hash file so we can tell if someone has changed the
 	// directory later, so we avoid overwriting their changes.
-	if err := writeHashFile(destDir, srcHash); err != nil {
+	if err := writeHashFile(destDir, srcHash, m.Version); err != nil {
 		return nil, errors.Wrap(err)
 	}
 	return repl, nil
 }
 
+// patchError is the error returned when patches
+// don't apply to the source of a module.
+type patchError struct {
+	path    string
+	version string
+	err     error
+}
+
+func (e *patchError) Error() string {
+	return fmt.Sprintf("cannot apply patches to %s@%s: %v", e.path, e.version, e.err)
+}
+
+// isPatchError reports whether err is a *patchError.
+func isPatchError(err error) bool {
+	_, ok := err.(*patchError)
+	return ok
+}
+
 func checkCleanWithoutVCS(dir string, modulePath string) (hash string, err error) {
-	wantHash, err := readHashFile(dir)
+	wantHash, _, err := readHashFile(dir)
 	if err != nil {
 		if !os.IsNotExist(errors.Cause(err)) {
 			return "", errors.Wrap(err)
@@ -207,29 +929,65 @@ func updateDirWithoutVCS(destDir, srcDir string) error {
 // TODO decide on a good name for this.
 const hashFile = ".gohack-modhash"
 
-func readHashFile(dir string) (string, error) {
+// readHashFile reads the hash file in dir, returning the hash
+// of the directory contents and the version of the module
+// that they were copied from. The version may be empty if it's
+// not known (older versions of gohack did not record it).
+func readHashFile(dir string) (hash, version string, err error) {
 	data, err := ioutil.ReadFile(filepath.Join(dir, hashFile))
 	if err != nil {
-		return "", errors.Note(err, os.IsNotExist, "")
+		return "", "", errors.Note(err, os.IsNotExist, "")
 	}
-	return strings.TrimSpace(string(data)), nil
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", "", nil
+	}
+	if len(fields) > 1 {
+		version = fields[1]
+	}
+	return fields[0], version, nil
 }
 
-func writeHashFile(dir string, hash string) error {
-	if err := ioutil.WriteFile(filepath.Join(dir, hashFile), []byte(hash), 0666); err != nil {
+func writeHashFile(dir string, hash, version string) error {
+	data := hash + "\n" + version + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, hashFile), []byte(data), 0666); err != nil {
 		return errors.Wrap(err)
 	}
 	return nil
 }
 
-func updateVCSDir(m *listModule) (*modReplace, error) {
-	info, err := getVCSInfoForModule(m)
+func updateVCSDir(m *listModule, dir, replDir string) (*modReplace, error) {
+	info, err := getVCSInfoForModule(m, dir, replDir)
+	if err != nil {
+		return nil, errors.Notef(err, nil, "cannot get info")
+	}
+	// Other modules may share the same checkout, so
+	// make sure that only one of them touches it at a time.
+	unlock := lockRepo(info.rootDir)
+	defer unlock()
+	// ... and that no other gohack process does either.
+	unlockDir, err := lockDir(info.rootDir)
 	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	defer unlockDir()
+	if err := info.readCheckout(); err != nil {
 		return nil, errors.Notef(err, nil, "cannot get info")
 	}
+	if forkTemplate != nil && !info.alreadyExists {
+		info.forkRepo, err = forkRepo(info)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+	}
 	if err := updateModule(info); err != nil {
 		return nil, errors.Wrap(err)
 	}
+	// Now that we've got the right version checked out, we can
+	// tell where the module actually lives in the repository.
+	if err := findModuleDir(info); err != nil {
+		return nil, errors.Wrap(err)
+	}
 	return &modReplace{
 		modulePath: m.Path,
 		dir:        info.dir,
@@ -244,73 +1002,403 @@ type modReplace struct {
 	dir string
 	// replDir holds the path to use for the module in the go.mod replace directive.
 	replDir string
+	// alreadyReplaced holds whether the go.mod file already
+	// holds the replace directive.
+	alreadyReplaced bool
+	// files holds the files that the replace directive is added to.
+	files []*modfile.File
+}
+
+// replDirFor returns the path to use for the module in
+// a replace directive in the file f.
+func (repl *modReplace) replDirFor(f *modfile.File) (string, error) {
+	if filepath.IsAbs(repl.replDir) {
+		return repl.replDir, nil
+	}
+	return relReplacePath(fileDir(f), repl.dir)
 }
 
-func replace(f *modfile.File, repls []*modReplace) error {
+// replace adds the replace directives for all the given replacements
+// and returns the files that have been changed.
+func replace(repls []*modReplace) (map[*modfile.File]bool, error) {
+	changed := make(map[*modfile.File]bool)
 	for _, repl := range repls {
-		if err := replaceModule(f, repl.modulePath, repl.replDir); err != nil {
-			return errors.Wrap(err)
+		if repl.alreadyReplaced {
+			continue
+		}
+		for _, f := range repl.files {
+			replDir, err := repl.replDirFor(f)
+			if err != nil {
+				return nil, errors.Wrap(err)
+			}
+			if err := replaceModule(f, repl.modulePath, replDir); err != nil {
+				return nil, errors.Wrap(err)
+			}
+			changed[f] = true
 		}
 	}
-	return nil
+	return changed, nil
+}
+
+var (
+	// repoMutex guards updatedRepos and repoLocks.
+	repoMutex sync.Mutex
+
+	// updatedRepos records the revision that each VCS checkout
+	// has been updated to by the current command, keyed by the
+	// checkout's root directory. Modules from the same
+	// repository share a checkout, so they must all use
+	// the same revision.
+	updatedRepos = make(map[string]string)
+
+	// getVersions holds the version, or version query, of each
+	// module being hacked by the current command, keyed by
+	// module path, so that modules sharing a checkout can
+	// be checked against each other before it's updated.
+	// It's written before any modules are fetched, so
+	// needs no locking.
+	getVersions = make(map[string]string)
+
+	// repoLocks holds a lock for each VCS checkout, keyed
+	// by the checkout's root directory.
+	repoLocks = make(map[string]*sync.Mutex)
+)
+
+// lockRepo acquires exclusive access to the VCS checkout
+// in rootDir and returns a function that releases it.
+func lockRepo(rootDir string) (unlock func()) {
+	repoMutex.Lock()
+	mu := repoLocks[rootDir]
+	if mu == nil {
+		mu = new(sync.Mutex)
+		repoLocks[rootDir] = mu
+	}
+	repoMutex.Unlock()
+	mu.Lock()
+	return mu.Unlock
 }
 
 func updateModule(info *moduleVCSInfo) error {
+	updateTo, isTag, err := info.versionRevision()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	repoMutex.Lock()
+	prev, ok := updatedRepos[info.rootDir]
+	repoMutex.Unlock()
+	if ok {
+		if prev == updateTo {
+			return nil
+		}
+		// Different tags can refer to the same revision.
+		prevID, err := resolveRevision(info.vcs, info.rootDir, prev)
+		if err == nil {
+			var id string
+			id, err = resolveRevision(info.vcs, info.rootDir, updateTo)
+			if err == nil && id == prevID {
+				return nil
+			}
+		}
+		return errors.Newf("%q has already been updated to %s for another module; cannot also update to %s", info.rootDir, prev, updateTo)
+	}
 	// Remove an auto-generated go.mod file if there is one
 	// to avoid confusing VCS logic.
-	if _, err := removeAutoGoMod(info); err != nil {
+	if _, err := removeAutoGoMod(info.dir, info.module.Path); err != nil {
 		return errors.Wrap(err)
 	}
-	if info.alreadyExists && !info.clean && *getForce {
-		if err := info.vcs.Clean(info.dir); err != nil {
+	if info.alreadyExists && !info.clean {
+		if !*getForce {
+			if len(info.changes) == 0 {
+				return errors.Newf("%q has %d unpushed revision(s); not updating", info.rootDir, len(info.unpushed))
+			}
+			return errors.Newf("%q is not clean; not updating", info.rootDir)
+		}
+		if !isGohackDir(info.rootDir) {
+			return errors.Newf("%q was not created by gohack; not cleaning it", info.rootDir)
+		}
+		if err := info.vcs.Clean(info.rootDir); err != nil {
 			return fmt.Errorf("cannot clean: %v", err)
 		}
 	}
+	branch, err := hackBranch(info)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if err := updateModule1(info, isTag, updateTo, branch); err != nil {
+		return errors.Wrap(err)
+	}
+	repoMutex.Lock()
+	updatedRepos[info.rootDir] = updateTo
+	repoMutex.Unlock()
+	return nil
+}
 
-	isTag := true
-	updateTo := info.module.Version
-	if IsPseudoVersion(updateTo) {
-		revID, err := PseudoVersionRev(updateTo)
+// versionRevision returns the VCS revision that corresponds
+// to the version of the module described by info, and
+// whether it's a tag.
+func (info *moduleVCSInfo) versionRevision() (rev string, isTag bool, err error) {
+	version := info.module.Version
+	if IsPseudoVersion(version) {
+		revID, err := PseudoVersionRev(version)
 		if err != nil {
-			return errors.Wrap(err)
+			return "", false, errors.Wrap(err)
 		}
-		isTag = false
-		updateTo = revID
-	} else {
-		// Not a pseudo-version. However, this can still be in the form
-		// of "<validtag>+incompatible", so trim the suffix.
-		updateTo = strings.TrimSuffix(updateTo, "+incompatible")
+		return revID, false, nil
 	}
-	if err := info.vcs.Update(info.dir, isTag, updateTo); err == nil {
-		fmt.Printf("updated hack version of %s to %s\n", info.module.Path, info.module.Version)
-		return nil
+	if !semver.IsValid(version) {
+		// Not a version at all: it's a VCS revision, such
+		// as a branch name or a commit hash, specified
+		// explicitly by the user.
+		return version, false, nil
 	}
+	// Not a pseudo-version. However, this can still be in the form
+	// of "<validtag>+incompatible", so trim the suffix.
+	version = strings.TrimSuffix(version, "+incompatible")
+	// Modules in a subdirectory are tagged with
+	// the subdirectory as a prefix.
+	return info.tagPrefix + version, true, nil
+}
+
+func updateModule1(info *moduleVCSInfo, isTag bool, updateTo, branch string) error {
 	if !info.alreadyExists {
-		fmt.Printf("creating %s@%s\n", info.module.Path, info.module.Version)
+		if err := checkCloneOptions(info.vcs, isTag); err != nil {
+			return errors.Wrap(err)
+		}
+		progressf("creating %s@%s\n", info.module.Path, info.module.Version)
 		if err := createRepo(info); err != nil {
 			return fmt.Errorf("cannot create repo: %v", err)
 		}
-	} else {
-		fmt.Printf("fetching %s@%s\n", info.module.Path, info.module.Version)
-		if err := info.vcs.Fetch(info.dir); err != nil {
-			return err
+	}
+	if err := checkSharedCheckout(info, isTag, updateTo); err != nil {
+		return errors.Wrap(err)
+	}
+	err := info.vcs.Update(info.rootDir, isTag, updateTo, branch)
+	if err == nil {
+		if info.alreadyExists {
+			progressf("updated hack version of %s to %s\n", info.module.Path, info.module.Version)
+		}
+		return nil
+	}
+	if !info.alreadyExists && *getDepth == 0 {
+		// A new clone holds all the history, so
+		// there's nothing more to fetch.
+		return err
+	}
+	// The revision may be newer than the checkout or, in
+	// a shallow clone, older than its history goes back.
+	progressf("fetching %s@%s\n", info.module.Path, info.module.Version)
+	if err := info.vcs.Fetch(info.rootDir, isTag, updateTo); err != nil {
+		return err
+	}
+	if *dryRun {
+		// Nothing was fetched, so the revision
+		// can't be resolved to check it out.
+		return nil
+	}
+	return info.vcs.Update(info.rootDir, isTag, updateTo, branch)
+}
+
+// checkSharedCheckout checks that updating the checkout for the
+// module described by info to the revision updateTo won't change
+// the revision used by any other module that shares the checkout,
+// either because it's already hacked there or because it's being
+// hacked by the current command. A checkout can only hold one
+// revision at a time, so, for example, when two major versions of
+// a module are developed on different branches, only one of
+// them can be hacked at once.
+func checkSharedCheckout(info *moduleVCSInfo, isTag bool, updateTo string) error {
+	others := sharedCheckoutRevisions(info)
+	if len(others) == 0 {
+		return nil
+	}
+	want, err := resolveRevision(info.vcs, info.rootDir, updateTo)
+	if err != nil {
+		if err := info.vcs.Fetch(info.rootDir, isTag, updateTo); err != nil {
+			return errors.Wrap(err)
+		}
+		want, err = resolveRevision(info.vcs, info.rootDir, updateTo)
+		if err != nil {
+			// Leave Update to report the problem.
+			return nil
 		}
 	}
-	return info.vcs.Update(info.dir, isTag, updateTo)
+	var conflicts []string
+	for _, other := range others {
+		have := info.revid
+		if other.rev != "" {
+			if have, err = resolveRevision(info.vcs, info.rootDir, other.rev); err != nil {
+				continue
+			}
+		}
+		if have != want {
+			conflicts = append(conflicts, other.path)
+		}
+	}
+	if len(conflicts) > 0 {
+		return errors.Newf("%q also holds %s at a different revision from %s; modules that share a checkout must be hacked at the same revision", info.rootDir, strings.Join(conflicts, ", "), updateTo)
+	}
+	return nil
+}
+
+// sharedRevision holds the revision required by
+// a module that shares a VCS checkout.
+type sharedRevision struct {
+	path string
+	// rev holds the revision that the module is being hacked
+	// at, or is empty if it's already hacked at the revision
+	// currently checked out.
+	rev string
+}
+
+// sharedCheckoutRevisions returns the other modules that share the
+// checkout for the module described by info, sorted by path.
+func sharedCheckoutRevisions(info *moduleVCSInfo) []sharedRevision {
+	var others []sharedRevision
+	for _, mpath := range hackedModules() {
+		if _, ok := getVersions[mpath]; ok || mpath == info.module.Path {
+			continue
+		}
+		f, r := findHackReplace(mpath)
+		dir := replaceDirPath(fileDir(f), r.New.Path)
+		if _, rootDir := findVCSRoot(dir, mpath); rootDir == info.rootDir {
+			others = append(others, sharedRevision{
+				path: mpath,
+			})
+		}
+	}
+	for mpath, version := range getVersions {
+		if mpath == info.module.Path || !strings.HasPrefix(mpath, info.root.Root+"/") {
+			continue
+		}
+		subdirs, err := moduleSubdirs(mpath, info.root.Root)
+		if err != nil {
+			continue
+		}
+		other := &moduleVCSInfo{
+			module: &listModule{
+				Path:    mpath,
+				Version: version,
+			},
+		}
+		if codeDir := subdirs[len(subdirs)-1]; codeDir != "" {
+			other.tagPrefix = codeDir + "/"
+		}
+		rev, _, err := other.versionRevision()
+		if err != nil {
+			continue
+		}
+		others = append(others, sharedRevision{
+			path: mpath,
+			rev:  rev,
+		})
+	}
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].path < others[j].path
+	})
+	return others
+}
+
+// checkCloneOptions checks that a new checkout made with v can
+// honour the -depth and -filter flags when checking out a revision,
+// which is a tag if isTag is true.
+func checkCloneOptions(v VCS, isTag bool) error {
+	if *getDepth == 0 && *getFilter == "" {
+		return nil
+	}
+	if _, ok := v.(goGitVCS); ok {
+		if *getFilter != "" {
+			return errors.Newf("-filter requires the git command; the built-in git implementation cannot make partial clones")
+		}
+		if !isTag {
+			// The revision may be older than the shallow history,
+			// and go-git can't deepen it.
+			return errors.Newf("-depth requires the git command for a version that isn't tagged; the built-in git implementation cannot deepen a shallow clone")
+		}
+		return nil
+	}
+	if v.Kind() != "git" {
+		return errors.Newf("-depth and -filter are not supported for %s repositories", v.Kind())
+	}
+	return nil
 }
 
 func createRepo(info *moduleVCSInfo) error {
 	// Some version control tools require the parent of the target to exist.
-	parent, _ := filepath.Split(info.dir)
+	parent, _ := filepath.Split(info.rootDir)
 	if err := os.MkdirAll(parent, 0777); err != nil {
 		return err
 	}
-	if err := info.vcs.Create(info.root.Repo, info.dir); err != nil {
+	opts := cloneOptions{
+		depth:  *getDepth,
+		filter: *getFilter,
+	}
+	if info.forkRepo == "" {
+		if err := info.vcs.Create(info.root.Repo, info.rootDir, opts); err != nil {
+			return errors.Wrap(err)
+		}
+		return nil
+	}
+	if err := info.vcs.Create(info.forkRepo, info.rootDir, opts); err != nil {
 		return errors.Wrap(err)
 	}
+	// The fork might not have the version we need, so
+	// make the upstream repository available too.
+	if err := addRemote(info.vcs, info.rootDir, upstreamRemote, info.root.Repo, opts); err != nil {
+		return errors.Notef(err, nil, "cannot add upstream repository")
+	}
 	return nil
 }
 
+// forkData holds the data passed to the -fork template.
+type forkData struct {
+	Path string // module path
+	Root string // import path of the repository root
+	Base string // last element of Root
+	Repo string // URL of the upstream repository
+}
+
+// forkRepo returns the URL of the fork to clone for
+// the module described by info, as specified by the -fork flag.
+func forkRepo(info *moduleVCSInfo) (string, error) {
+	var buf bytes.Buffer
+	err := forkTemplate.Execute(&buf, forkData{
+		Path: info.module.Path,
+		Root: info.root.Root,
+		Base: path.Base(info.root.Root),
+		Repo: info.root.Repo,
+	})
+	if err != nil {
+		return "", errors.Notef(err, nil, "cannot determine fork URL")
+	}
+	return buf.String(), nil
+}
+
+// branchData holds the data passed to the -branch template.
+type branchData struct {
+	MainModule string // path of the main module
+	Path       string // module path
+	Version    string // module version being checked out
+}
+
+// hackBranch returns the name of the branch to check out
+// for the module described by info, as specified by the -branch flag,
+// or "" if no branch should be used.
+func hackBranch(info *moduleVCSInfo) (string, error) {
+	if branchTemplate == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	err := branchTemplate.Execute(&buf, branchData{
+		MainModule: mainModFile.Module.Mod.Path,
+		Path:       info.module.Path,
+		Version:    info.module.Version,
+	})
+	if err != nil {
+		return "", errors.Notef(err, nil, "cannot determine branch name")
+	}
+	return buf.String(), nil
+}
+
 func ensureGoModFile(modPath, dir string) error {
 	goModPath := filepath.Join(dir, "go.mod")
 	if _, err := os.Stat(goModPath); err == nil {
@@ -322,12 +1410,12 @@ func ensureGoModFile(modPath, dir string) error {
 	return nil
 }
 
-// removeAutoGoMod removes the module directory's go.mod
-// file if it looks like it's been autogenerated by us.
-// It reports whether the file was removed.
-func removeAutoGoMod(m *moduleVCSInfo) (bool, error) {
-	goModPath := filepath.Join(m.dir, "go.mod")
-	ok, err := isAutoGoMod(goModPath, m.module.Path)
+// removeAutoGoMod removes the go.mod file in the directory
+// of the module with the given path if it looks like it's been
+// autogenerated by us. It reports whether the file was removed.
+func removeAutoGoMod(dir, modulePath string) (bool, error) {
+	goModPath := filepath.Join(dir, "go.mod")
+	ok, err := isAutoGoMod(goModPath, modulePath)
 	if err != nil || !ok {
 		return false, err
 	}
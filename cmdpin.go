@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rogpeppe/go-internal/modfile"
+	"github.com/rogpeppe/go-internal/module"
+	"github.com/rogpeppe/go-internal/semver"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+var pinCommand = &Command{
+	UsageLine: "pin [-path path] module",
+	Short:     "replace a VCS hack by the pseudo-version of its pushed revision",
+	Long: `
+The pin command changes the replace directive for a module hacked
+with -vcs so that, instead of the directory, it refers to the
+pseudo-version of the revision checked out there. This makes it
+possible to share a fix that has been pushed to a fork without
+waiting for it to be released upstream.
+
+The revision must have been pushed, so the directory must not have
+any local changes or unpushed revisions. The pseudo-version is
+derived from the time of the revision and the most recent version
+tag among its ancestors, as the go command does.
+
+The -path flag specifies the module path to use in the replace
+directive. By default, if the directory was created with the -fork
+flag, the path is derived from the URL of the fork, and otherwise the
+module's own path is used.
+
+The directory is left in place, and the replaced version is noted
+in a comment so that "gohack undo" restores whatever the module was
+replaced by before it was hacked.
+`[1:],
+}
+
+func init() {
+	pinCommand.Run = cmdPin // break init cycle
+}
+
+var pinPath = pinCommand.Flag.String("path", "", "module `path` to replace the module with")
+
+// pinComment is added to the start of the comment on a replace
+// directive changed by gohack pin, so that it can be undone.
+const pinComment = "// gohack pin"
+
+func cmdPin(_ *Command, args []string) int {
+	if len(args) != 1 {
+		errorf("pin requires exactly one module argument")
+		return 2
+	}
+	if err := cmdPin1(args[0]); err != nil {
+		errorf("%v", err)
+	}
+	return 0
+}
+
+func cmdPin1(mpath string) error {
+	info, err := vcsHackInfo(mpath)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	unlock, err := lockDir(info.rootDir)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer unlock()
+	if err := info.readCheckout(); err != nil {
+		return errors.Wrap(err)
+	}
+	if len(info.changes) > 0 {
+		return errors.Newf("%q has uncommitted changes:\n\t%s", info.rootDir, strings.Join(info.changes, "\n\t"))
+	}
+	if len(info.unpushed) > 0 {
+		return errors.Newf("%q has %d unpushed revision(s); push them before pinning", info.rootDir, len(info.unpushed))
+	}
+	version, err := pinVersion(info)
+	if err != nil {
+		return errors.Notef(err, nil, "cannot determine pseudo-version")
+	}
+	newPath := *pinPath
+	if newPath == "" {
+		newPath = forkModulePath(info)
+	}
+	if err := module.Check(newPath, version); err != nil {
+		return errors.Wrap(err)
+	}
+	pinned := module.Version{
+		Path:    newPath,
+		Version: version,
+	}
+	for _, f := range replaceFiles() {
+		r := findDirReplace(f, mpath)
+		if r == nil {
+			continue
+		}
+		pinReplace(r, pinned)
+		if err := writeModFile(f); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	fmt.Printf("%s => %s\n", mpath, versionPath(pinned))
+	return nil
+}
+
+// pinVersion returns the pseudo-version for the revision checked
+// out in the VCS directory for the module described by info.
+func pinVersion(info *moduleVCSInfo) (string, error) {
+	t, err := revTime(info.vcs, info.rootDir)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	tags, err := ancestorTags(info.vcs, info.rootDir)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	major := ""
+	if _, pathMajor, ok := module.SplitPathVersion(info.module.Path); ok && pathMajor != "" {
+		major = pathMajor[1:]
+	}
+	older := ""
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, info.tagPrefix) {
+			continue
+		}
+		tag = tag[len(info.tagPrefix):]
+		if !semver.IsValid(tag) || semver.Build(tag) != "" {
+			continue
+		}
+		// Only tags with the module's major version
+		// can be used as the base of its pseudo-versions.
+		if tagMajor := semver.Major(tag); major == "" && tagMajor != "v0" && tagMajor != "v1" || major != "" && tagMajor != major {
+			continue
+		}
+		if semver.Compare(tag, older) > 0 {
+			older = tag
+		}
+	}
+	return CommitPseudoVersion(major, older, t, info.revid)
+}
+
+// forkModulePath returns the module path corresponding to the
+// module described by info in the repository that its VCS directory
+// was cloned from, if that's a fork, or the module's own path
+// otherwise.
+func forkModulePath(info *moduleVCSInfo) string {
+	if info.vcs.Kind() != "git" {
+		return info.module.Path
+	}
+	if _, err := remoteURL(info.vcs, info.rootDir, upstreamRemote); err != nil {
+		// Not a fork.
+		return info.module.Path
+	}
+	url, err := remoteURL(info.vcs, info.rootDir, "origin")
+	if err != nil {
+		return info.module.Path
+	}
+	host, repoPath, ok := parseRepoURL(url)
+	if !ok {
+		return info.module.Path
+	}
+	// Keep any subdirectory and major version
+	// suffix of the module path.
+	return host + "/" + repoPath + strings.TrimPrefix(info.module.Path, info.root.Root)
+}
+
+// pinReplace changes the replace directive r to replace its module
+// with the given module version. Any existing comment is preserved
+// after pinComment so that undoReplacements can restore the previous
+// replacement.
+func pinReplace(r *modfile.Replace, pinned module.Version) {
+	comments := &r.Syntax.Comments
+	if len(comments.Suffix) > 0 {
+		comments.Suffix[0].Token = pinComment + " " + comments.Suffix[0].Token
+	} else {
+		comments.Suffix = []modfile.Comment{{
+			Token: pinComment,
+		}}
+	}
+	r.New = pinned
+	tokens := tokensForReplace(r.Old, r.New)
+	if r.Syntax.InBlock {
+		tokens = tokens[1:]
+	}
+	r.Syntax.Token = tokens
+}
+
+// isPinned reports whether the replace directive r
+// was changed by gohack pin.
+func isPinned(r *modfile.Replace) bool {
+	comments := r.Syntax.Comments.Suffix
+	return r.Old.Version == "" && r.New.Version != "" && len(comments) > 0 && (comments[0].Token == pinComment || strings.HasPrefix(comments[0].Token, pinComment+" "))
+}
+
+// pinnedModules returns the paths of all the modules whose
+// replace directives were changed by gohack pin.
+func pinnedModules() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, f := range replaceFiles() {
+		for _, r := range f.Replace {
+			if isPinned(r) && !seen[r.Old.Path] {
+				seen[r.Old.Path] = true
+				paths = append(paths, r.Old.Path)
+			}
+		}
+	}
+	return paths
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+var pushCommand = &Command{
+	UsageLine: "push [-b branch] [-remote name] module",
+	Short:     "push the commits in a VCS hack for an upstream pull request",
+	Long: `
+The push command prepares the commits made in the VCS directory of
+the given module for contribution upstream. It creates a branch
+holding the commits made since the version of the module required by
+the main module, rebased onto the default branch of the upstream
+repository, and pushes it. The directory itself is left as it is.
+Only git repositories are supported, and the git command must be
+installed; the built-in implementation used with -gogit can't push.
+
+The upstream repository is the remote named "upstream" if there is
+one (see the -fork flag in "gohack help get"), or the remote that the
+branch is pushed to otherwise. The -remote flag specifies the remote
+to push to; it defaults to "origin".
+
+The -b flag specifies the name of the branch to create, which
+defaults to "gohack-" followed by the last element of the repository
+path. The branch is pushed with --force-with-lease so that it can be
+pushed again after making further changes.
+
+If the repositories are hosted on GitHub, GitLab, Gitea (including
+Codeberg) or Bitbucket, the URL of a page for creating a pull
+request is printed.
+`[1:],
+}
+
+func init() {
+	pushCommand.Run = cmdPush // break init cycle
+}
+
+var (
+	pushBranch = pushCommand.Flag.String("b", "", "name of the `branch` to push")
+	pushRemote = pushCommand.Flag.String("remote", "origin", "`name` of the remote to push to")
+)
+
+func cmdPush(_ *Command, args []string) int {
+	if len(args) != 1 {
+		errorf("push requires exactly one module argument")
+		return 2
+	}
+	if err := cmdPush1(args[0]); err != nil {
+		errorf("%v", err)
+	}
+	return 0
+}
+
+func cmdPush1(mpath string) error {
+	info, err := vcsHackInfo(mpath)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if info.vcs.Kind() != "git" {
+		return errors.Newf("cannot push %s repositories", info.vcs.Kind())
+	}
+	if _, ok := info.vcs.(goGitVCS); ok {
+		// Rebasing onto the upstream branch needs git itself.
+		return errors.Newf("push requires the git command; the built-in git implementation cannot push")
+	}
+	unlock, err := lockDir(info.rootDir)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer unlock()
+	if err := info.readCheckout(); err != nil {
+		return errors.Wrap(err)
+	}
+	if len(info.changes) > 0 {
+		return errors.Newf("%q has uncommitted changes:\n\t%s", info.rootDir, strings.Join(info.changes, "\n\t"))
+	}
+	base, _, err := info.versionRevision()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	out, err := runCmd(info.rootDir, "git", "rev-list", base+"..HEAD")
+	if err != nil {
+		return errors.Notef(err, nil, "cannot find commits since %s", base)
+	}
+	if len(statusLines(out)) == 0 {
+		return errors.Newf("no commits to push since %s", base)
+	}
+	remote := *pushRemote
+	upstream, err := upstreamRemoteFor(info.rootDir, remote)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	branch := *pushBranch
+	if branch == "" {
+		branch = "gohack-" + path.Base(info.root.Root)
+	}
+	if branch == currentBranch(info.vcs, info.rootDir) {
+		return errors.Newf("branch %q is checked out in %q; use -b to choose another name", branch, info.rootDir)
+	}
+	if _, err := runCmd(info.rootDir, "git", "fetch", "-q", upstream); err != nil {
+		return errors.Notef(err, nil, "cannot fetch from %s", upstream)
+	}
+	defaultBranch, err := remoteDefaultBranch(info.rootDir, upstream)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if err := rebaseBranch(info.rootDir, branch, base, upstream+"/"+defaultBranch); err != nil {
+		return errors.Wrap(err)
+	}
+	if _, err := runUpdateCmd(info.rootDir, "git", "push", "-q", "--force-with-lease", "-u", remote, branch); err != nil {
+		return errors.Notef(err, nil, "cannot push to %s", remote)
+	}
+	progressf("pushed %s to %s\n", branch, remote)
+	upstreamURL, _ := runCmd(info.rootDir, "git", "config", "--get", "remote."+upstream+".url")
+	forkURL, _ := runCmd(info.rootDir, "git", "config", "--get", "remote."+remote+".url")
+	if u := compareURL(strings.TrimSpace(upstreamURL), strings.TrimSpace(forkURL), defaultBranch, branch); u != "" {
+		fmt.Println(u)
+	}
+	return nil
+}
+
+// upstreamRemoteFor returns the name of the upstream remote in the
+// git checkout in dir, given that the branch will be pushed to
+// the given remote.
+func upstreamRemoteFor(dir, remote string) (string, error) {
+	out, err := runCmd(dir, "git", "remote")
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	found, upstream := false, remote
+	for _, name := range statusLines(out) {
+		switch strings.TrimSpace(name) {
+		case remote:
+			found = true
+		case upstreamRemote:
+			upstream = upstreamRemote
+		}
+	}
+	if !found {
+		return "", errors.Newf("no remote named %q in %q", remote, dir)
+	}
+	return upstream, nil
+}
+
+// remoteDefaultBranch returns the name of the default
+// branch of the given remote of the git checkout in dir.
+func remoteDefaultBranch(dir, remote string) (string, error) {
+	out, err := runCmd(dir, "git", "ls-remote", "--symref", remote, "HEAD")
+	if err == nil {
+		for _, line := range statusLines(out) {
+			if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" {
+				return strings.TrimPrefix(fields[1], "refs/heads/"), nil
+			}
+		}
+	}
+	// Fall back to what we knew about the remote's HEAD when it was cloned.
+	out, err = runCmd(dir, "git", "symbolic-ref", "--short", "refs/remotes/"+remote+"/HEAD")
+	if err != nil {
+		return "", errors.Newf("cannot determine the default branch of %s", remote)
+	}
+	return strings.TrimPrefix(strings.TrimSpace(out), remote+"/"), nil
+}
+
+// rebaseBranch creates or resets the given branch in the git checkout
+// in dir to hold the commits between base and HEAD rebased onto the
+// revision onto. It does so in a temporary worktree so that
+// the checkout itself isn't changed.
+func rebaseBranch(dir, branch, base, onto string) error {
+	tmpDir, err := ioutil.TempDir("", "gohack-push-")
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if _, err := runUpdateCmd(dir, "git", "worktree", "add", "-q", "-B", branch, tmpDir, "HEAD"); err != nil {
+		return errors.Notef(err, nil, "cannot create branch %q", branch)
+	}
+	defer runUpdateCmd(dir, "git", "worktree", "remove", "--force", tmpDir)
+	if _, err := runUpdateCmd(tmpDir, "git", "rebase", "-q", "--onto", onto, base); err != nil {
+		runCmd(tmpDir, "git", "rebase", "--abort")
+		return errors.Notef(err, nil, "cannot rebase onto %s", onto)
+	}
+	return nil
+}
+
+// compareURL returns the URL of the web page for creating a pull request
+// from the given branch of the repository with URL forkURL to the base
+// branch of the upstream repository, or "" if it's not known how to
+// make one.
+func compareURL(upstreamURL, forkURL, base, branch string) string {
+	upHost, upPath, ok := parseRepoURL(upstreamURL)
+	if !ok {
+		return ""
+	}
+	forkHost, forkPath, ok := parseRepoURL(forkURL)
+	if !ok || forkHost != upHost {
+		return ""
+	}
+	head := branch
+	if forkPath != upPath {
+		head = path.Dir(forkPath) + ":" + branch
+	}
+	switch repoHostKind(upHost) {
+	case "github":
+		return fmt.Sprintf("https://%s/%s/compare/%s...%s?expand=1", upHost, upPath, base, head)
+	case "gitea":
+		return fmt.Sprintf("https://%s/%s/compare/%s...%s", upHost, upPath, base, head)
+	case "gitlab":
+		// Merge requests from a fork target the
+		// upstream project by default.
+		return fmt.Sprintf("https://%s/%s/-/merge_requests/new?%s", forkHost, forkPath, url.Values{
+			"merge_request[source_branch]": {branch},
+			"merge_request[target_branch]": {base},
+		}.Encode())
+	case "bitbucket":
+		return fmt.Sprintf("https://%s/%s/pull-requests/new?%s", forkHost, forkPath, url.Values{
+			"source": {branch},
+			"dest":   {upPath + "::" + base},
+		}.Encode())
+	}
+	return ""
+}
+
+// repoHostKind returns the kind of the repository hosting service
+// at the given host, or "" if it isn't known.
+func repoHostKind(host string) string {
+	switch {
+	case host == "github.com" || strings.HasPrefix(host, "github."):
+		return "github"
+	case host == "gitlab.com" || strings.HasPrefix(host, "gitlab."):
+		return "gitlab"
+	case host == "gitea.com" || host == "codeberg.org" || strings.HasPrefix(host, "gitea."):
+		return "gitea"
+	case host == "bitbucket.org":
+		return "bitbucket"
+	}
+	return ""
+}
+
+// parseRepoURL returns the host and the slash-separated path of
+// the repository with the given URL, which may also be in the
+// scp-like form used by ssh (user@host:path). It reports false if
+// the URL doesn't refer to a repository on a remote host.
+func parseRepoURL(s string) (host, repoPath string, ok bool) {
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme == "file" {
+			return "", "", false
+		}
+		host, repoPath = u.Hostname(), u.Path
+	} else {
+		i := strings.Index(s, ":")
+		if i < 0 || strings.Contains(s[:i], "/") {
+			// A local path.
+			return "", "", false
+		}
+		host, repoPath = s[:i], s[i+1:]
+		host = host[strings.Index(host, "@")+1:]
+	}
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+	if host == "" || !strings.Contains(repoPath, "/") {
+		return "", "", false
+	}
+	return host, repoPath, true
+}
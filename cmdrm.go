@@ -0,0 +1,335 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rogpeppe/go-internal/modfile"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+var rmCommand = &Command{
+	UsageLine: "rm [-f] [-all-modules | -modules dirs] module...",
+	Short:     "stop hacking a module and remove its directory",
+	Long: `
+The rm command removes the gohack directories for the
+given modules and then removes the relevant replace statements
+from the go.mod file as for the undo command.
+
+A directory is only removed if it is clean. A directory created
+without the -vcs flag is clean if its contents are unchanged since gohack
+last wrote it; a VCS directory is clean if there are no uncommitted
+changes and no commits that have not been pushed.
+A directory is also not removed if any other go.mod file in the
+main module's directory tree still refers to it.
+
+Modules hacked with -vcs may share a checkout of their repository
+(see "gohack help get"). The whole checkout is removed, but only
+along with the last of the modules that are hacked in it; until
+then, only the replace statement is removed.
+
+The -all-modules and -modules flags are as for the undo command;
+go.mod files of the specified main modules don't prevent a directory
+from being removed.
+
+If the -f flag is provided, the directories are removed regardless,
+except that a directory holding the main module is never removed.
+Neither is a directory that gohack didn't create: only directories
+inside the gohack directory or made by "gohack get" without -vcs
+can be removed.
+`[1:],
+}
+
+func init() {
+	rmCommand.Run = cmdRm // break init cycle
+	addModulesFlags(rmCommand)
+}
+
+var rmForce = rmCommand.Flag.Bool("f", false, "remove directories even if they are not clean")
+
+func cmdRm(_ *Command, args []string) int {
+	if len(args) == 0 {
+		errorf("rm requires at least one module argument")
+		return 2
+	}
+	if err := cmdRm1(args, *rmForce); err != nil {
+		errorf("%v", err)
+	}
+	return 0
+}
+
+func cmdRm1(modules []string, force bool) error {
+	removed := removeHackDirs(modules, force)
+	if len(removed) == 0 {
+		return errors.New("no directories removed; not dropping any replacements")
+	}
+	return cmdUndo1(removed)
+}
+
+// removeHackDirs removes the hack directories for all the given
+// modules and returns the modules whose directories were
+// successfully removed. It refuses to remove directories that are not
+// clean unless force is true.
+//
+// A VCS checkout may hold several hacked modules, in which case
+// the whole checkout is removed, but only once none of the other
+// modules are hacked any more. Until then, the module is
+// returned as if its directory had been removed, so that
+// its replacement is dropped.
+func removeHackDirs(modules []string, force bool) []string {
+	removing := make(map[string]bool)
+	for _, mpath := range modules {
+		removing[mpath] = true
+	}
+	removedDirs := make(map[string]bool)
+	var removed []string
+	for _, mpath := range modules {
+		dir, err := hackDirForModule(mpath)
+		if err != nil {
+			errorf("%v", err)
+			continue
+		}
+		if !isGohackDir(dir) {
+			// Not even -f should remove the user's own directories.
+			errorf("cannot remove %s: %q was not created by gohack", mpath, dir)
+			continue
+		}
+		if isWithinAny(dir, removedDirs) {
+			// Removed along with another module
+			// in the same checkout.
+			removed = append(removed, mpath)
+			continue
+		}
+		rootDir := hackRootDir(mpath, dir)
+		if holdsMainModule(rootDir) {
+			// Not even -f should remove the main module.
+			errorf("cannot remove %s: %q holds the main module", mpath, rootDir)
+			continue
+		}
+		if users := otherHacksInDir(rootDir, removing); len(users) > 0 {
+			progressf("not removing %s, which also holds %s\n", rootDir, strings.Join(users, ", "))
+			removed = append(removed, mpath)
+			continue
+		}
+		if err := removeHackDir(mpath, dir, rootDir, force); err != nil {
+			errorf("cannot remove %s: %v", mpath, err)
+			continue
+		}
+		progressf("removed %s\n", rootDir)
+		removedDirs[rootDir] = true
+		removed = append(removed, mpath)
+	}
+	return removed
+}
+
+// removeHackDir removes the directory rootDir holding the hack
+// directory dir for the module with the given path, checking first
+// that it can be removed unless force is true.
+func removeHackDir(mpath, dir, rootDir string, force bool) error {
+	unlock, err := lockDir(rootDir)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer unlock()
+	if !force {
+		if err := checkCanRemove(mpath, dir, rootDir); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	if err := os.RemoveAll(rootDir); err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// hackRootDir returns the directory to remove for the hack
+// directory dir of the module with the given path: the root
+// of the VCS checkout holding it, or dir itself.
+func hackRootDir(mpath, dir string) string {
+	if _, err := os.Stat(filepath.Join(dir, hashFile)); err == nil {
+		return dir
+	}
+	if v, rootDir := findVCSRoot(dir, mpath); v != nil {
+		return rootDir
+	}
+	return dir
+}
+
+// otherHacksInDir returns the paths of the modules, other than those
+// in exclude, that are replaced by dir or a directory inside it.
+func otherHacksInDir(dir string, exclude map[string]bool) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, f := range replaceFiles() {
+		for _, r := range f.Replace {
+			if r.Old.Version != "" || r.New.Version != "" || exclude[r.Old.Path] || seen[r.Old.Path] {
+				continue
+			}
+			if isWithinDir(replaceDirPath(fileDir(f), r.New.Path), dir) {
+				seen[r.Old.Path] = true
+				paths = append(paths, r.Old.Path)
+			}
+		}
+	}
+	return paths
+}
+
+// isWithinAny reports whether path is inside any of the given directories.
+func isWithinAny(path string, dirs map[string]bool) bool {
+	for dir := range dirs {
+		if isWithinDir(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithinDir reports whether path is dir or is inside it.
+func isWithinDir(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// hackDirForModule returns the absolute path of the directory
+// that replaces the given module in the main module's go.mod file
+// or the go.work file.
+func hackDirForModule(mpath string) (string, error) {
+	if f, r := findHackReplace(mpath); r != nil {
+		return replaceDirPath(fileDir(f), r.New.Path), nil
+	}
+	return "", errors.Newf("%s not currently replaced by a directory; cannot remove", mpath)
+}
+
+// replaceDirPath returns the absolute path of the directory
+// referred to by the replacement path replPath in the go.mod
+// file in modDir.
+func replaceDirPath(modDir, replPath string) string {
+	if filepath.IsAbs(replPath) {
+		return filepath.Clean(replPath)
+	}
+	return filepath.Join(modDir, replPath)
+}
+
+// checkCanRemove checks that the hack directory dir for the
+// module with the given path is clean and that rootDir, the
+// directory holding it, is not used by any other go.mod file.
+func checkCanRemove(mpath, dir, rootDir string) error {
+	if err := checkHackClean(mpath, dir); err != nil {
+		return errors.Wrap(err)
+	}
+	users, err := otherGoModsUsingDir(rootDir)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if len(users) > 0 {
+		return errors.Newf("%q is still used by:\n\t%s", rootDir, strings.Join(users, "\n\t"))
+	}
+	return nil
+}
+
+// checkHackClean checks that the hack directory dir for the
+// module with the given path holds no changes that would be lost
+// if it was removed.
+func checkHackClean(mpath, dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, hashFile)); err == nil {
+		if _, err := checkCleanWithoutVCS(dir, mpath); err == nil {
+			return nil
+		}
+		changed, err := changedFilesForHack(mpath, dir)
+		if err != nil {
+			return errors.Newf("%q is not clean", dir)
+		}
+		return errors.Newf("%q is not clean; changed files:\n\t%s", dir, strings.Join(changed, "\n\t"))
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err)
+	}
+	v, rootDir := findVCSRoot(dir, mpath)
+	if v == nil {
+		return errors.Newf("%q was not created by gohack", dir)
+	}
+	info, err := vcsInfoForDir(v, rootDir, dir, mpath)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if len(info.changes) > 0 {
+		return errors.Newf("%q is not clean:\n\t%s", rootDir, strings.Join(info.changes, "\n\t"))
+	}
+	if len(info.unpushed) > 0 {
+		return errors.Newf("%q has %d unpushed revision(s), including %s", rootDir, len(info.unpushed), info.unpushed[0])
+	}
+	return nil
+}
+
+// changedFilesForHack returns the files in the non-VCS hack
+// directory dir that differ from the pristine module source.
+func changedFilesForHack(mpath, dir string) ([]string, error) {
+	srcDir, err := pristineDirForHack(mpath)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return changedFiles(dir, srcDir, mpath)
+}
+
+// pristineDirForHack returns the directory holding the
+// pristine source of the hacked module with the given path.
+func pristineDirForHack(mpath string) (string, error) {
+	mods, err := listModules(mpath)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	m := mods[mpath]
+	if m == nil {
+		return "", errors.Newf("module %q not found", mpath)
+	}
+	src, err := pristineModule(m, downloadModule)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	return src.Dir, nil
+}
+
+// otherGoModsUsingDir returns the paths of any go.mod files
+// other than those of the main modules within the main module's directory
+// tree that have a replace directive referring to dir or a directory inside it.
+func otherGoModsUsingDir(dir string) ([]string, error) {
+	root := filepath.Dir(mainModFile.Syntax.Name)
+	var users []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			name := info.Name()
+			if path == dir || path != root && (name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() != "go.mod" || isMainModFile(path) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		f, err := modfile.Parse(path, data, nil)
+		if err != nil {
+			// Ignore go.mod files we can't parse.
+			return nil
+		}
+		for _, r := range f.Replace {
+			if r.New.Version == "" && isWithinDir(replaceDirPath(filepath.Dir(path), r.New.Path), dir) {
+				users = append(users, path)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	sort.Strings(users)
+	return users, nil
+}
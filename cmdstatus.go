@@ -2,36 +2,399 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rogpeppe/go-internal/modfile"
+	"github.com/rogpeppe/go-internal/module"
+	"github.com/rogpeppe/go-internal/semver"
+	"gopkg.in/errgo.v2/fmt/errors"
 )
 
 var statusCommand = &Command{
-	Run:       cmdStatus,
 	Short:     "print the current hack status of a module",
-	UsageLine: "status [module...]",
+	UsageLine: "status [-all-modules | -modules dirs] [-json] [module...]",
 	Long: `
 The status command prints the status of
 all modules that are currently replaced by local
 directories. If arguments are given, it prints information
 about only the specified modules.
+
+For each module, it prints the replacement followed by
+indented lines showing:
+
+- whether the directory was created with -vcs ("vcs")
+or without ("copy");
+- the checked-out revision, for VCS directories, the
+branch (or Mercurial bookmark) that is checked out and the
+remote branch that it tracks, if any;
+- whether the directory is clean (has no local changes and,
+for VCS directories, no revisions that haven't been pushed);
+- the version of the module that would be used without the
+replacement, marked "out of date" if the directory is known to
+hold a different version (for example because it was created
+with "gohack get module@version").
+
+If the -all-modules or -modules flags are provided (see "gohack help get"),
+the replacements in the go.mod files of all the specified
+main modules are printed, each preceded by the name of its file.
+
+If the -json flag is specified, the status of each module is printed
+as a JSON object with the following fields:
+
+	type Status struct {
+		Path        string // module path
+		Old         string // replacement without the hack, if any
+		New         string // replacement directory as used in go.mod
+		Dir         string // absolute path to the replacement directory
+		Mode        string // "vcs", "copy" or "" if unknown
+		VCS         string // VCS kind in vcs mode
+		Revid       string // checked out revision in vcs mode
+		Revno       string // revision number or time in vcs mode
+		Branch      string // checked out branch or bookmark in vcs mode
+		Tracking    string // remote branch tracked by the current branch in vcs mode
+		Clean       bool   // directory has no local changes or unpushed revisions
+		Version     string // version used without the replacement
+		HackVersion string // version held in the directory, if known
+		OutOfDate   bool   // directory holds a version other than Version
+		File        string // file holding the replacement, with -all-modules or -modules
+		Error       *struct {
+			Err string // error for the module
+		}
+	}
+
+The get and undo commands print the same structure
+for each module when given the -json flag.
 `[1:],
 }
 
+func init() {
+	statusCommand.Run = cmdStatus // break init cycle
+	addJSONFlag(statusCommand)
+	addModulesFlags(statusCommand)
+}
+
 func cmdStatus(_ *Command, args []string) int {
-	if len(args) > 0 {
-		errorf("explicit module status not yet implemented")
-		return 2
-	}
-	if err := printReplacementInfo(); err != nil {
+	if err := printReplacementInfo(args); err != nil {
 		errorf("%v", err)
 	}
 	return 0
 }
 
-func printReplacementInfo() error {
-	for _, r := range mainModFile.Replace {
-		if r.Old.Version == "" && r.New.Version == "" {
+// hackStatus holds the status of a hacked module.
+// It is also used for the JSON output of the
+// get, status and undo commands.
+type hackStatus struct {
+	// Path holds the module path.
+	Path string
+	// Old holds the replacement for the module that is in effect
+	// without the hack, if any, in the form "path" or "path version".
+	Old string `json:",omitempty"`
+	// New holds the replacement path as found in the go.mod file.
+	New string `json:",omitempty"`
+	// Dir holds the absolute path to the replacement directory.
+	Dir string `json:",omitempty"`
+	// Mode holds "vcs" if the directory is a VCS checkout,
+	// "copy" if it was created without -vcs, or "" if unknown.
+	Mode string `json:",omitempty"`
+	// VCS holds the kind of VCS used in VCS mode.
+	VCS string `json:",omitempty"`
+	// Revid and Revno hold the checked out revision in VCS mode.
+	Revid string `json:",omitempty"`
+	Revno string `json:",omitempty"`
+	// Branch holds the checked out branch, or the active
+	// bookmark for Mercurial, in VCS mode, if any.
+	Branch string `json:",omitempty"`
+	// Tracking holds the remote branch tracked by the
+	// current branch in VCS mode, if any.
+	Tracking string `json:",omitempty"`
+	// Clean holds whether the directory has no local changes
+	// and, in VCS mode, no unpushed revisions.
+	Clean bool
+	// Version holds the version of the module that would be
+	// used without the replacement.
+	Version string `json:",omitempty"`
+	// HackVersion holds the version of the module held in the
+	// directory, if known.
+	HackVersion string `json:",omitempty"`
+	// OutOfDate holds whether the directory is known to hold
+	// a version other than Version.
+	OutOfDate bool `json:",omitempty"`
+	// File holds the go.mod or go.work file holding the replacement
+	// when operating on several main modules.
+	File string `json:",omitempty"`
+	// Error holds any error encountered for the module.
+	Error *listModuleError `json:",omitempty"`
+}
+
+// hackReplace holds a replace directive that replaces
+// a module by a directory, and the file holding it.
+type hackReplace struct {
+	file    *modfile.File
+	replace *modfile.Replace
+}
+
+func printReplacementInfo(modules []string) error {
+	paths := hackedModules()
+	if len(modules) > 0 {
+		paths = modules
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	// When operating on several main modules, print the
+	// replacements in each go.mod file; otherwise print the
+	// replacement that's in effect.
+	multi := len(mainModFiles) > 1
+	var repls []hackReplace
+	for _, mpath := range paths {
+		found := false
+		if multi {
+			for _, f := range replaceFiles() {
+				if r := findDirReplace(f, mpath); r != nil {
+					repls = append(repls, hackReplace{f, r})
+					found = true
+				}
+			}
+		} else if f, r := findHackReplace(mpath); r != nil {
+			repls = append(repls, hackReplace{f, r})
+			found = true
+		}
+		if !found {
+			repls = append(repls, hackReplace{replace: &modfile.Replace{
+				Old: module.Version{Path: mpath},
+			}})
+		}
+	}
+	modsByDir := make(map[string]map[string]*listModule)
+	listMods := func(dir string) map[string]*listModule {
+		if mods, ok := modsByDir[dir]; ok {
+			return mods
+		}
+		mods, err := listModulesIn(dir, "all")
+		if err != nil {
+			// We can still print something useful without the
+			// version information.
+			errorf("cannot get module info: %v", err)
+			mods = nil
+		}
+		modsByDir[dir] = mods
+		return mods
+	}
+	var results []*hackStatus
+	for _, hr := range repls {
+		f, r := hr.file, hr.replace
+		mpath := r.Old.Path
+		if f == nil {
+			st := &hackStatus{
+				Path: mpath,
+			}
+			failf(st, "%s is not currently replaced by a directory", mpath)
+			results = append(results, st)
+			continue
+		}
+		dir := cwd
+		if multi {
+			dir = fileDir(f)
+		}
+		st, err := getHackStatus(f, r, listMods(dir)[mpath])
+		if !jsonOutput {
+			if multi {
+				fmt.Printf("%s: ", relPath(f.Syntax.Name))
+			}
 			fmt.Printf("%s => %s\n", r.Old.Path, r.New.Path)
 		}
+		if err != nil {
+			st = &hackStatus{
+				Path: mpath,
+				New:  r.New.Path,
+			}
+			failf(st, "cannot get status of %s: %v", mpath, err)
+		} else if !jsonOutput {
+			printHackStatus(st)
+		}
+		if multi {
+			st.File = f.Syntax.Name
+		}
+		results = append(results, st)
+	}
+	if jsonOutput {
+		return printJSON(results)
 	}
 	return nil
 }
+
+// getHackStatus returns the status of the module hacked
+// by the given replacement in the file f. The module m holds the go list
+// information on the module; it may be nil if that's not available.
+func getHackStatus(f *modfile.File, r *modfile.Replace, m *listModule) (*hackStatus, error) {
+	st := &hackStatus{
+		Path: r.Old.Path,
+		New:  r.New.Path,
+		Dir:  replaceDirPath(fileDir(f), r.New.Path),
+	}
+	if len(r.Syntax.Comments.Suffix) > 0 {
+		if prev := splitWasComment(r.Syntax.Comments.Suffix[0].Token); prev != nil {
+			st.Old = versionPath(prev.New)
+		}
+	}
+	if m != nil {
+		st.Version = m.Version
+	}
+	if _, err := os.Stat(st.Dir); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	wantHash, hackVersion, err := readHashFile(st.Dir)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrap(err)
+	}
+	if err == nil {
+		st.Mode = "copy"
+		st.HackVersion = hackVersion
+		gotHash, err := hashDir(st.Dir, st.Path)
+		if err != nil {
+			return nil, errors.Notef(err, nil, "cannot hash %q", st.Dir)
+		}
+		st.Clean = gotHash == wantHash
+		if m == nil {
+			return st, nil
+		}
+		st.OutOfDate = st.HackVersion != "" && st.HackVersion != st.Version
+		// Status doesn't go to the network, so we can only compare
+		// the contents with the source if it's in the module cache.
+		if src, err := pristineModule(m, cachedModule); err == nil {
+			srcHash, err := hashDir(src.Dir, st.Path)
+			if err != nil {
+				return nil, errors.Notef(err, nil, "cannot hash %q", src.Dir)
+			}
+			st.OutOfDate = st.OutOfDate || srcHash != wantHash
+		}
+		return st, nil
+	}
+	v, rootDir := findVCSRoot(st.Dir, st.Path)
+	if v == nil {
+		// Not a directory created by gohack; we can't tell much.
+		return st, nil
+	}
+	st.Mode = "vcs"
+	st.VCS = v.Kind()
+	info, err := vcsInfoForDir(v, rootDir, st.Dir, st.Path)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	st.Revid, st.Revno, st.Clean = info.revid, info.revno, info.clean
+	st.Branch = currentBranch(v, rootDir)
+	st.Tracking = trackedBranch(v, rootDir)
+	st.HackVersion = vcsHackVersion(v, rootDir, st.Dir, st.Path, st.Version, info)
+	if st.HackVersion != "" && st.Version != "" {
+		st.OutOfDate = st.HackVersion != st.Version
+	}
+	return st, nil
+}
+
+// vcsHackVersion returns the module version corresponding to the
+// revision checked out in the VCS directory rootDir, which holds
+// the module in dir, or "" if it cannot be determined. The version
+// argument holds the version of the module required by the main module.
+func vcsHackVersion(v VCS, rootDir, dir string, modulePath, version string, info VCSInfo) string {
+	if IsPseudoVersion(version) {
+		if rev, err := PseudoVersionRev(version); err == nil && strings.HasPrefix(info.revid, rev) {
+			return version
+		}
+	}
+	_, pathMajor, _ := module.SplitPathVersion(modulePath)
+	prefix := vcsTagPrefix(rootDir, dir, pathMajor)
+	tags, _ := revTags(v, rootDir)
+	best := ""
+	for _, tag := range tags {
+		// Tags for modules in subdirectories have the
+		// subdirectory as a prefix; tags with any other prefix
+		// belong to other modules in the repository.
+		if !strings.HasPrefix(tag, prefix) {
+			continue
+		}
+		tag = tag[len(prefix):]
+		if !semver.IsValid(tag) || pathMajor != "" && !module.MatchPathMajor(tag, pathMajor) {
+			continue
+		}
+		if tag == strings.TrimSuffix(version, "+incompatible") {
+			return version
+		}
+		if semver.Compare(tag, best) > 0 {
+			best = tag
+		}
+	}
+	if best != "" {
+		return best
+	}
+	// Git reports the commit time as the revno, which
+	// is enough to make a pseudo-version.
+	t, err := time.Parse(time.RFC3339, info.revno)
+	if err != nil {
+		return ""
+	}
+	major := ""
+	if _, pathMajor, ok := module.SplitPathVersion(modulePath); ok && pathMajor != "" {
+		major = pathMajor[1:]
+	}
+	pv, err := CommitPseudoVersion(major, "", t, info.revid)
+	if err != nil {
+		return ""
+	}
+	return pv
+}
+
+// vcsTagPrefix returns the prefix of the version tags for the
+// module in the directory dir of the VCS checkout in rootDir,
+// given the major version suffix of its module path.
+// As for moduleSubdirs, a major version suffix isn't part of the
+// prefix even when the module is in the corresponding subdirectory.
+func vcsTagPrefix(rootDir, dir, pathMajor string) string {
+	rel, err := filepath.Rel(rootDir, dir)
+	if err != nil || rel == "." {
+		return ""
+	}
+	rel = filepath.ToSlash(rel)
+	if strings.HasPrefix(pathMajor, "/") {
+		if rel == pathMajor[1:] {
+			return ""
+		}
+		rel = strings.TrimSuffix(rel, pathMajor)
+	}
+	return rel + "/"
+}
+
+func printHackStatus(st *hackStatus) {
+	switch st.Mode {
+	case "copy":
+		fmt.Printf("\tmode: copy\n")
+	case "vcs":
+		fmt.Printf("\tmode: vcs (%s)\n", st.VCS)
+		if st.Revno != "" {
+			fmt.Printf("\trevision: %s (%s)\n", st.Revid, st.Revno)
+		} else {
+			fmt.Printf("\trevision: %s\n", st.Revid)
+		}
+		if st.Branch != "" {
+			fmt.Printf("\tbranch: %s\n", st.Branch)
+		}
+		if st.Tracking != "" {
+			fmt.Printf("\ttracking: %s\n", st.Tracking)
+		}
+	default:
+		fmt.Printf("\tmode: unknown\n")
+		return
+	}
+	fmt.Printf("\tclean: %v\n", st.Clean)
+	if st.Version != "" {
+		if st.OutOfDate && st.HackVersion != "" {
+			fmt.Printf("\tversion: %s (out of date; hack has %s)\n", st.Version, st.HackVersion)
+		} else if st.OutOfDate {
+			fmt.Printf("\tversion: %s (out of date)\n", st.Version)
+		} else {
+			fmt.Printf("\tversion: %s\n", st.Version)
+		}
+	}
+}
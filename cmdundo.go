@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"regexp"
 	"sort"
 	"strings"
@@ -13,31 +14,103 @@ import (
 )
 
 var undoCommand = &Command{
-	Run:       cmdUndo,
 	Short:     "stop hacking a module",
-	UsageLine: "undo [-rm] [-f] [module...]",
+	UsageLine: "undo [-rm] [-f] [-restore] [-all-modules | -modules dirs] [-json] [module...]",
 	Long: `
 The undo command can be used to revert to the non-gohacked
 module versions. It only removes the relevant replace
 statements from the go.mod file - it does not change any
 of the directories referred to. With no arguments, all replace
-statements that refer to directories will
-be removed.
+statements that refer to directories, or that have been changed
+by the pin command, will be removed.
+
+If the -rm flag is provided, the directories are removed too,
+as for the rm command. Directories that are not clean
+will not be removed (and their replace statements will
+be left alone) unless the -f flag is also provided.
+With no arguments, only the modules replaced by directories
+that gohack created are affected.
+
+If the -all-modules or -modules flags are provided, the replace
+statements are removed from the go.mod files of all the
+specified main modules, as described in "gohack help get".
+
+If the -json flag is provided, the result for each module is printed
+as a JSON object in the format described by "gohack help status".
+The Old field holds the replacement that has been restored, if any.
+
+Whenever gohack changes a go.mod or go.work file, it saves the
+previous contents in a file with a .gohack-backup suffix.
+If the -restore flag is provided, the main module's go.mod file
+and the go.work file are restored from those backup files instead.
+This can be used to recover if a file has been corrupted.
 `[1:],
 }
 
+func init() {
+	undoCommand.Run = cmdUndo // break init cycle
+	addJSONFlag(undoCommand)
+	addModulesFlags(undoCommand)
+}
+
 var (
 	undoRemove     = undoCommand.Flag.Bool("rm", false, "remove module directory too")
 	undoForceClean = undoCommand.Flag.Bool("f", false, "force cleaning of modified-but-not-committed repositories. Do not use this flag unless you really need to!")
+	undoRestore    = undoCommand.Flag.Bool("restore", false, "restore go.mod and go.work from their backup files")
 )
 
 func cmdUndo(_ *Command, args []string) int {
+	if *undoRemove {
+		if len(args) == 0 {
+			args = createdHacks()
+		}
+		if err := cmdRm1(args, *undoForceClean); err != nil {
+			errorf("%v", err)
+		}
+		return 0
+	}
 	if err := cmdUndo1(args); err != nil {
 		errorf("%v", err)
 	}
 	return 0
 }
 
+// cmdUndoRestore restores the main module's go.mod file and the go.work
+// file, if any, from the backups made when gohack last changed them.
+func cmdUndoRestore() error {
+	if len(undoCommand.Flag.Args()) > 0 {
+		return errors.New("-restore does not take any module arguments")
+	}
+	goModPath, err := findGoMod(cwd)
+	if err != nil {
+		return errors.Notef(err, nil, "cannot find main module")
+	}
+	paths := []string{goModPath}
+	if out, err := runCmd(cwd, "go", "env", "GOWORK"); err == nil {
+		if p := strings.TrimSpace(out); p != "" && p != "off" {
+			paths = append(paths, p)
+		}
+	}
+	restored := 0
+	for _, path := range paths {
+		if _, err := os.Stat(path + backupSuffix); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrap(err)
+		}
+		if err := restoreModFile(path); err != nil {
+			return errors.Notef(err, nil, "cannot restore %s", path)
+		}
+		fmt.Printf("restored %s\n", path)
+		restored++
+	}
+	if restored == 0 {
+		return errors.New("no backup files found")
+	}
+	return nil
+}
+
 func cmdUndo1(modules []string) error {
 	modMap := make(map[string]bool)
 	if len(modules) > 0 {
@@ -46,28 +119,94 @@ func cmdUndo1(modules []string) error {
 		}
 	} else {
 		// With no modules specified, we un-gohack all modules
-		// we can find with local directory info in the go.mod file.
-		for _, r := range mainModFile.Replace {
-			if r.Old.Version == "" && r.New.Version == "" {
-				modMap[r.Old.Path] = true
-				modules = append(modules, r.Old.Path)
+		// we can find with local directory info or pinned
+		// versions in the go.mod and go.work files.
+		for _, m := range append(hackedModules(), pinnedModules()...) {
+			if !modMap[m] {
+				modMap[m] = true
+				modules = append(modules, m)
 			}
 		}
 	}
+	results := make(map[string]*hackStatus)
+	for _, m := range modules {
+		results[m] = &hackStatus{
+			Path: m,
+		}
+	}
+	// A module can be replaced in both go.mod and go.work,
+	// so undo the replacements in all the files.
+	undone := make(map[string]bool)
+	for _, f := range replaceFiles() {
+		changed, err := undoReplacements(f, modMap, undone, results)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		if !changed {
+			continue
+		}
+		if err := writeModFile(f); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	var failed []string
+	for _, m := range modules {
+		if !undone[m] {
+			failed = append(failed, m)
+		}
+	}
+	sort.Strings(failed)
+	for _, m := range failed {
+		failf(results[m], "%s not currently replaced; cannot drop", m)
+	}
+	if jsonOutput {
+		sts := make([]*hackStatus, len(modules))
+		for i, m := range modules {
+			sts[i] = results[m]
+		}
+		return printJSON(sts)
+	}
+	for _, m := range modules {
+		if undone[m] {
+			fmt.Printf("dropped %s\n", m)
+		}
+	}
+	return nil
+}
+
+// undoReplacements removes the directory replacements in f for all
+// the modules in modMap, restoring any replacements they
+// replaced. It records the modules that have been undone in undone
+// and the results in results. It reports whether f has been changed.
+func undoReplacements(f *modfile.File, modMap, undone map[string]bool, results map[string]*hackStatus) (bool, error) {
+	changed := false
 	drop := make(map[string]bool)
-	for _, r := range mainModFile.Replace {
-		if !modMap[r.Old.Path] || r.Old.Version != "" || r.New.Version != "" {
+	for _, r := range f.Replace {
+		pinned := isPinned(r)
+		if !modMap[r.Old.Path] || r.Old.Version != "" || r.New.Version != "" && !pinned {
 			continue
 		}
 		// Found a replacement to drop.
+		changed = true
+		undone[r.Old.Path] = true
+		results[r.Old.Path].New = versionPath(r.New)
 		comments := r.Syntax.Comments
 		if len(comments.Suffix) == 0 {
 			// No comment; we can just drop it.
 			drop[r.Old.Path] = true
-			delete(modMap, r.Old.Path)
 			continue
 		}
-		prevReplace := splitWasComment(comments.Suffix[0].Token)
+		token := comments.Suffix[0].Token
+		if pinned {
+			// The comment from before the module was
+			// pinned follows the pin comment.
+			token = strings.TrimSpace(strings.TrimPrefix(token, pinComment))
+			if token == "" {
+				drop[r.Old.Path] = true
+				continue
+			}
+		}
+		prevReplace := splitWasComment(token)
 		if prevReplace != nil && prevReplace.Old.Path == r.Old.Path {
 			// We're popping the old replace statement.
 			if r.Syntax.InBlock {
@@ -77,6 +216,7 @@ func cmdUndo1(modules []string) error {
 			// Preserve any before and after comments.
 			prevReplace.Syntax.Before = r.Syntax.Before
 			prevReplace.Syntax.After = r.Syntax.After
+			results[r.Old.Path].Old = versionPath(prevReplace.New)
 			r.Old = prevReplace.Old
 			r.New = prevReplace.New
 			r.Syntax.Comments.Suffix = prevReplace.Syntax.Comments.Suffix
@@ -86,28 +226,13 @@ func cmdUndo1(modules []string) error {
 			// interfere with the current range statement).
 			drop[r.Old.Path] = true
 		}
-		delete(modMap, r.Old.Path)
 	}
 	for m := range drop {
-		if err := mainModFile.DropReplace(m, ""); err != nil {
-			return errors.Notef(err, nil, "cannot drop replacement for %v", m)
+		if err := f.DropReplace(m, ""); err != nil {
+			return false, errors.Notef(err, nil, "cannot drop replacement for %v", m)
 		}
 	}
-	failed := make([]string, 0, len(modMap))
-	for m := range modMap {
-		failed = append(failed, m)
-	}
-	sort.Strings(failed)
-	for _, m := range failed {
-		errorf("%s not currently replaced; cannot drop", m)
-	}
-	if err := writeModFile(mainModFile); err != nil {
-		return errors.Wrap(err)
-	}
-	for _, m := range modules {
-		fmt.Printf("dropped %s\n", m)
-	}
-	return nil
+	return changed, nil
 }
 
 // wasCommentPat matches a comment of the form inserted by gohack get,
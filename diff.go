@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// diffContext holds the number of lines of context
+// printed around each change in a unified diff.
+const diffContext = 3
+
+// maxDiffEdits holds the edit distance beyond which diffLines
+// stops looking for a minimal diff and replaces all the
+// differing lines instead.
+const maxDiffEdits = 1000
+
+// noNewline is printed in a unified diff after a line that
+// isn't terminated by a newline.
+const noNewline = "\\ No newline at end of file\n"
+
+// diffOp holds one line of an edit script. Its kind
+// is ' ' for a line in both files, '-' for a line
+// that's only in the old file and '+' for a line that's
+// only in the new file.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// splitLines splits data into lines, each including
+// its terminating newline, if any.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// isBinary reports whether data looks like the
+// contents of a binary file.
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// unifiedDiff returns a unified diff that turns the old contents
+// into the new contents, using the given file names in its header.
+// It returns nil if the contents are the same.
+func unifiedDiff(oldName, newName string, old, new []byte) []byte {
+	if bytes.Equal(old, new) {
+		return nil
+	}
+	var buf bytes.Buffer
+	if isBinary(old) || isBinary(new) {
+		fmt.Fprintf(&buf, "Binary files %s and %s differ\n", oldName, newName)
+		return buf.Bytes()
+	}
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+	ops := diffLines(splitLines(old), splitLines(new))
+	// oldLine and newLine hold the number of lines
+	// of each file before ops[i].
+	oldLine, newLine := 0, 0
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+		// Find the end of the hunk, which includes all the changes
+		// that aren't separated by more than twice the context.
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+		oldStart, newStart := oldLine-(i-start), newLine-(i-start)
+		oldCount, newCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+		for _, op := range ops[start:end] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				buf.WriteString("\n" + noNewline)
+			}
+		}
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				oldLine++
+			}
+			if op.kind != '-' {
+				newLine++
+			}
+		}
+		i = end
+	}
+	return buf.Bytes()
+}
+
+// hunkRange formats the range of lines in a hunk
+// that starts after the given number of lines.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		// An empty range refers to the line before it.
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// diffLines returns an edit script that turns the lines in a
+// into the lines in b. It uses Myers' algorithm.
+func diffLines(a, b []string) []diffOp {
+	// Trim the common prefix and suffix, which is
+	// often all but a few lines.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxDiffEdits {
+		max = maxDiffEdits
+	}
+	// v[off+k] holds the furthest x reached on diagonal k.
+	off := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] holds v as it was before looking for
+	// paths with d edits.
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		// The files are too different for it to be
+		// worth finding a minimal diff.
+		var ops []diffOp
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+	// Walk back through the trace to find the edits,
+	// which are added to ops in reverse order.
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for ; x > 0; x-- {
+		ops = append(ops, diffOp{' ', a[x-1]})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// filePatch holds the changes to a single file
+// in a unified diff.
+type filePatch struct {
+	// oldName and newName hold the file names
+	// from the "---" and "+++" lines.
+	oldName string
+	newName string
+	hunks   []*hunk
+}
+
+// hunk holds a single hunk of changes in a unified diff.
+type hunk struct {
+	// line holds the line number of the hunk in the patch file.
+	line int
+	// oldStart holds the line number of the first line
+	// of the hunk in the old file.
+	oldStart int
+	// ops holds the lines of the hunk.
+	ops []diffOp
+}
+
+// parsePatch parses the unified diff in data, which was read from the
+// file with the given name. Any lines outside the
+// file changes, such as "diff" or "index" lines, are ignored,
+// but changes to binary files can't be applied, so
+// they're an error.
+func parsePatch(name string, data []byte) ([]*filePatch, error) {
+	lines := splitLines(data)
+	var patches []*filePatch
+	for i := 0; i < len(lines); i++ {
+		if isBinaryChange(lines[i]) {
+			// Rather than silently skip the change and
+			// leave the file as it was, refuse to apply
+			// the patch at all.
+			return nil, errors.Newf("%s:%d: cannot apply change to binary file: %s", name, i+1, strings.TrimSuffix(lines[i], "\n"))
+		}
+		if !strings.HasPrefix(lines[i], "--- ") || i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ ") {
+			continue
+		}
+		fp := &filePatch{
+			oldName: patchFileName(lines[i][len("--- "):]),
+			newName: patchFileName(lines[i+1][len("+++ "):]),
+		}
+		i += 2
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@ ") {
+			h, n, err := parseHunk(lines[i:])
+			if err != nil {
+				return nil, errors.Newf("%s:%d: %v", name, i+1, err)
+			}
+			h.line = i + 1
+			fp.hunks = append(fp.hunks, h)
+			i += n
+		}
+		if len(fp.hunks) == 0 {
+			return nil, errors.Newf("%s:%d: no hunks found for %s", name, i+1, fp.newName)
+		}
+		patches = append(patches, fp)
+		i--
+	}
+	if len(patches) == 0 {
+		return nil, errors.Newf("%s: no changes found", name)
+	}
+	return patches, nil
+}
+
+// isBinaryChange reports whether line describes a change
+// to a binary file, as printed by unifiedDiff, diff or git.
+func isBinaryChange(line string) bool {
+	line = strings.TrimSuffix(line, "\n")
+	return line == "GIT binary patch" || strings.HasPrefix(line, "Binary files ") && strings.HasSuffix(line, " differ")
+}
+
+// patchFileName returns the file name from a "---" or "+++"
+// line, without any timestamp following it.
+func patchFileName(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// parseHunk parses the hunk at the start of lines
+// and returns it along with the number of lines it takes up.
+func parseHunk(lines []string) (*hunk, int, error) {
+	fields := strings.Fields(lines[0])
+	if len(fields) < 4 || fields[3] != "@@" || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return nil, 0, errors.Newf("invalid hunk header %q", strings.TrimSuffix(lines[0], "\n"))
+	}
+	oldStart, oldCount, err := parseHunkRange(fields[1][1:])
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	_, newCount, err := parseHunkRange(fields[2][1:])
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+	h := &hunk{
+		oldStart: oldStart,
+	}
+	if oldCount == 0 {
+		// An empty range refers to the line before it.
+		h.oldStart++
+	}
+	i := 1
+	for ; oldCount > 0 || newCount > 0; i++ {
+		if i >= len(lines) {
+			return nil, 0, errors.Newf("unexpected end of hunk")
+		}
+		line := lines[i]
+		if line == "\n" {
+			// Some tools strip the trailing space from empty context lines.
+			line = " \n"
+		}
+		switch line[0] {
+		case ' ':
+			oldCount--
+			newCount--
+		case '-':
+			oldCount--
+		case '+':
+			newCount--
+		case '\\':
+			continue
+		default:
+			return nil, 0, errors.Newf("unexpected line %q in hunk", strings.TrimSuffix(line, "\n"))
+		}
+		if oldCount < 0 || newCount < 0 {
+			return nil, 0, errors.Newf("hunk has more lines than its header says")
+		}
+		h.ops = append(h.ops, diffOp{line[0], line[1:]})
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\\") {
+			// The line has no terminating newline.
+			op := &h.ops[len(h.ops)-1]
+			op.line = strings.TrimSuffix(op.line, "\n")
+			i++
+		}
+	}
+	return h, i, nil
+}
+
+// parseHunkRange parses a line range of the form "start,count"
+// or "start" from a hunk header.
+func parseHunkRange(s string) (start, count int, err error) {
+	count = 1
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		count, err = strconv.Atoi(s[i+1:])
+		if err != nil {
+			return 0, 0, errors.Newf("invalid hunk range %q", s)
+		}
+		s = s[:i]
+	}
+	start, err = strconv.Atoi(s)
+	if err != nil {
+		return 0, 0, errors.Newf("invalid hunk range %q", s)
+	}
+	return start, count, nil
+}
+
+// apply applies the changes in the patch to the given
+// contents of the old file, returning the new contents.
+// If the context of a hunk isn't found at the expected place,
+// the nearest place where it matches is used instead.
+func (fp *filePatch) apply(data []byte) ([]byte, error) {
+	lines := splitLines(data)
+	var buf bytes.Buffer
+	// cur holds the index of the first line of the old
+	// file that hasn't been copied yet, and offset holds
+	// the difference between where the last hunk was
+	// expected and where it was found.
+	cur, offset := 0, 0
+	for _, h := range fp.hunks {
+		var old []string
+		for _, op := range h.ops {
+			if op.kind != '+' {
+				old = append(old, op.line)
+			}
+		}
+		pos := findLines(lines, old, h.oldStart-1+offset, cur)
+		if pos < 0 {
+			return nil, errors.Newf("hunk at line %d does not apply", h.line)
+		}
+		offset = pos - (h.oldStart - 1)
+		for _, line := range lines[cur:pos] {
+			buf.WriteString(line)
+		}
+		for _, op := range h.ops {
+			if op.kind != '-' {
+				buf.WriteString(op.line)
+			}
+		}
+		cur = pos + len(old)
+	}
+	for _, line := range lines[cur:] {
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), nil
+}
+
+// findLines returns the index of the place in lines nearest to want
+// and not before min where the lines in find occur, or -1 if there is none.
+func findLines(lines, find []string, want, min int) int {
+	matches := func(pos int) bool {
+		if pos < min || pos+len(find) > len(lines) {
+			return false
+		}
+		for i, line := range find {
+			if lines[pos+i] != line {
+				return false
+			}
+		}
+		return true
+	}
+	for d := 0; want-d >= min || want+d <= len(lines); d++ {
+		if matches(want - d) {
+			return want - d
+		}
+		if matches(want + d) {
+			return want + d
+		}
+	}
+	return -1
+}
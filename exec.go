@@ -12,6 +12,12 @@ import (
 )
 
 func runCmd(dir string, name string, args ...string) (string, error) {
+	return runCmdEnv(dir, nil, name, args...)
+}
+
+// runCmdEnv is like runCmd but adds the given
+// "key=value" entries to the command's environment.
+func runCmdEnv(dir string, env []string, name string, args ...string) (string, error) {
 	var outData, errData bytes.Buffer
 	if *printCommands {
 		printShellCommand(dir, name, args)
@@ -20,6 +26,9 @@ func runCmd(dir string, name string, args ...string) (string, error) {
 	c.Stdout = &outData
 	c.Stderr = &errData
 	c.Dir = dir
+	if env != nil {
+		c.Env = append(os.Environ(), env...)
+	}
 	err := c.Run()
 	if err == nil {
 		return outData.String(), nil
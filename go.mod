@@ -1,8 +1,11 @@
 module github.com/rogpeppe/gohack
 
 require (
-	github.com/rogpeppe/go-internal v1.5.0
-	golang.org/x/tools v0.0.0-20180917221912-90fa682c2a6e
+	github.com/go-git/go-billy/v5 v5.4.1
+	github.com/go-git/go-git/v5 v5.8.1
+	github.com/rogpeppe/go-internal v1.9.0
+	golang.org/x/sys v0.10.0
+	golang.org/x/tools v0.7.0
 	gopkg.in/errgo.v2 v2.1.0
 )
 
@@ -0,0 +1,752 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+var useGoGit = flag.Bool("gogit", false, "use the built-in git implementation instead of the git command")
+
+// selectGitVCS arranges for git repositories to be handled by
+// goGitVCS when the -gogit flag is specified or there's
+// no git command available.
+func selectGitVCS() {
+	if !*useGoGit {
+		if _, err := exec.LookPath("git"); err == nil {
+			return
+		}
+	}
+	kindToVCS["git"] = goGitVCS{}
+	// By default, go-git runs git-upload-pack to fetch from
+	// repositories in the local file system, so serve them
+	// in-process instead.
+	client.InstallProtocol("file", server.NewClient(localRepoLoader{}))
+}
+
+// goGitVCS implements VCS for git using the go-git library,
+// so that it works without the git command. It behaves in the same
+// way as gitVCS.
+type goGitVCS struct{}
+
+func (goGitVCS) Kind() string {
+	return "git"
+}
+
+func (goGitVCS) Info(dir string) (VCSInfo, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	status, err := w.Status()
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	// The Status String method prints lines in the same
+	// format as git status --porcelain, but in no particular
+	// order.
+	changes := statusLines(status.String())
+	sort.Strings(changes)
+	// As for gitVCS, tags count as pushed.
+	var starts, excludes []plumbing.Hash
+	starts = append(starts, head.Hash())
+	err = forEachCommitRef(r, func(name plumbing.ReferenceName, h plumbing.Hash) {
+		switch {
+		case name.IsBranch() && !strings.HasPrefix(name.Short(), backupBranchPrefix):
+			starts = append(starts, h)
+		case name.IsRemote(), name.IsTag():
+			excludes = append(excludes, h)
+		}
+	})
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	unpushed, err := revsNotIn(r, starts, excludes)
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	return VCSInfo{
+		revid:    head.Hash().String(),
+		clean:    len(changes) == 0 && len(unpushed) == 0,
+		changes:  changes,
+		unpushed: unpushed,
+		revno:    commit.Committer.When.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+func (goGitVCS) Create(repo, rootDir string, opts cloneOptions) error {
+	if opts.filter != "" {
+		return fmt.Errorf("the built-in git implementation cannot make partial clones")
+	}
+	if !goGitUpdate("", gitCloneArgs(repo, rootDir, opts)...) {
+		return nil
+	}
+	_, err := git.PlainClone(rootDir, false, &git.CloneOptions{
+		URL:   repo,
+		Depth: opts.depth,
+	})
+	return err
+}
+
+func (goGitVCS) Update(dir string, isTag bool, revid, branch string) error {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	target, err := r.ResolveRevision(plumbing.Revision(revid))
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s: %v", revid, err)
+	}
+	if branch == "" {
+		if !goGitUpdate(dir, "checkout", revid) {
+			return nil
+		}
+		return keepIgnored(r, w, dir, func() error {
+			return w.Checkout(&git.CheckoutOptions{
+				Hash: *target,
+			})
+		})
+	}
+	ref := plumbing.NewBranchReferenceName(branch)
+	if cur, err := r.Reference(ref, true); err == nil {
+		targetCommit, err := r.CommitObject(*target)
+		if err != nil {
+			return err
+		}
+		branchCommit, err := r.CommitObject(cur.Hash())
+		if err != nil {
+			return err
+		}
+		if ok, err := targetCommit.IsAncestor(branchCommit); err != nil {
+			return err
+		} else if ok || targetCommit.Hash == branchCommit.Hash {
+			// The branch already holds the revision,
+			// perhaps with local commits on top of it.
+			if !goGitUpdate(dir, "checkout", branch) {
+				return nil
+			}
+			return keepIgnored(r, w, dir, func() error {
+				return w.Checkout(&git.CheckoutOptions{
+					Branch: ref,
+				})
+			})
+		}
+		excludes := []plumbing.Hash{*target}
+		err = forEachCommitRef(r, func(name plumbing.ReferenceName, h plumbing.Hash) {
+			if name.IsRemote() {
+				excludes = append(excludes, h)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		local, err := revsNotIn(r, []plumbing.Hash{cur.Hash()}, excludes)
+		if err != nil {
+			return err
+		}
+		if len(local) > 0 {
+			return fmt.Errorf("branch %q has local commits that are not in %s; not moving it", branch, revid)
+		}
+	}
+	if !goGitUpdate(dir, "checkout", "-B", branch, target.String()) {
+		return nil
+	}
+	if err := r.Storer.SetReference(plumbing.NewHashReference(ref, *target)); err != nil {
+		return err
+	}
+	return keepIgnored(r, w, dir, func() error {
+		return w.Checkout(&git.CheckoutOptions{
+			Branch: ref,
+		})
+	})
+}
+
+func (goGitVCS) Clean(dir string) error {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	// As for gitVCS, keep revisions that are only
+	// reachable from a detached HEAD on a branch.
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	if !head.Name().IsBranch() {
+		var excludes []plumbing.Hash
+		err := forEachCommitRef(r, func(name plumbing.ReferenceName, h plumbing.Hash) {
+			if name.IsBranch() || name.IsRemote() || name.IsTag() {
+				excludes = append(excludes, h)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		unpushed, err := revsNotIn(r, []plumbing.Hash{head.Hash()}, excludes)
+		if err != nil {
+			return err
+		}
+		if len(unpushed) > 0 {
+			branch := backupBranch(head.Hash().String())
+			if goGitUpdate(dir, "branch", "-f", branch, "HEAD") {
+				ref := plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), head.Hash())
+				if err := r.Storer.SetReference(ref); err != nil {
+					return err
+				}
+			}
+			progressf("saved unpushed revisions in branch %s\n", branch)
+		}
+	}
+	if goGitUpdate(dir, "reset", "--hard", "HEAD") {
+		err := keepIgnored(r, w, dir, func() error {
+			return w.Reset(&git.ResetOptions{
+				Mode: git.HardReset,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !goGitUpdate(dir, "clean", "-f", "-d") {
+		return nil
+	}
+	return w.Clean(&git.CleanOptions{
+		Dir: true,
+	})
+}
+
+func (goGitVCS) Fetch(dir string, isTag bool, revid string) error {
+	if !goGitUpdate(dir, "fetch", "--all") {
+		return nil
+	}
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	remotes, err := r.Remotes()
+	if err != nil {
+		return err
+	}
+	// Fetch from all remotes so that the upstream
+	// repository is included when cloned from a fork.
+	for _, remote := range remotes {
+		err := r.Fetch(&git.FetchOptions{
+			RemoteName: remote.Config().Name,
+		})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return err
+		}
+	}
+	shallow, err := r.Storer.Shallow()
+	if err != nil || len(shallow) == 0 {
+		return err
+	}
+	if _, err := r.ResolveRevision(plumbing.Revision(revid)); err == nil {
+		return nil
+	}
+	if !isTag {
+		// go-git can't deepen the history of a shallow clone.
+		return fmt.Errorf("%s is not in the history of the shallow clone; the built-in git implementation cannot deepen it", revid)
+	}
+	// As for gitVCS, fetch the tag itself with no
+	// more history than it needs.
+	ref := plumbing.NewTagReferenceName(revid)
+	for _, remote := range remotes {
+		goGitUpdate(dir, "fetch", "--depth", "1", remote.Config().Name, "tag", revid)
+		err := r.Fetch(&git.FetchOptions{
+			RemoteName: remote.Config().Name,
+			RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+" + ref + ":" + ref)},
+			Depth:      1,
+		})
+		if err == nil || err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot fetch tag %s", revid)
+}
+
+// addRemote implements addRemote for goGitVCS.
+func (goGitVCS) addRemote(dir, name, url string, opts cloneOptions) error {
+	if !goGitUpdate(dir, "remote", "add", "-f", name, url) {
+		return nil
+	}
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	remote, err := r.CreateRemote(&gitconfig.RemoteConfig{
+		Name: name,
+		URLs: []string{url},
+	})
+	if err != nil {
+		return err
+	}
+	err = remote.Fetch(&git.FetchOptions{
+		Depth: opts.depth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	return nil
+}
+
+// currentBranch implements currentBranch for goGitVCS.
+func (goGitVCS) currentBranch(dir string) string {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return ""
+	}
+	head, err := r.Reference(plumbing.HEAD, false)
+	if err != nil || head.Type() != plumbing.SymbolicReference {
+		// HEAD is detached.
+		return ""
+	}
+	return head.Target().Short()
+}
+
+// resolveRevision implements resolveRevision for goGitVCS.
+func (goGitVCS) resolveRevision(dir, rev string) (string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return "", err
+	}
+	h, err := r.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return "", err
+	}
+	return h.String(), nil
+}
+
+// trackedBranch implements trackedBranch for goGitVCS.
+func (goGitVCS) trackedBranch(dir string) string {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return ""
+	}
+	head, err := r.Head()
+	if err != nil || !head.Name().IsBranch() {
+		return ""
+	}
+	cfg, err := r.Config()
+	if err != nil {
+		return ""
+	}
+	b := cfg.Branches[head.Name().Short()]
+	if b == nil || b.Remote == "" || !b.Merge.IsBranch() {
+		return ""
+	}
+	if b.Remote == "." {
+		// The branch tracks another local branch.
+		return b.Merge.Short()
+	}
+	return b.Remote + "/" + b.Merge.Short()
+}
+
+// ancestorTags implements ancestorTags for goGitVCS.
+func (goGitVCS) ancestorTags(dir string) ([]string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+	tagsByCommit := make(map[plumbing.Hash][]string)
+	err = forEachCommitRef(r, func(name plumbing.ReferenceName, h plumbing.Hash) {
+		if name.IsTag() {
+			tagsByCommit[h] = append(tagsByCommit[h], name.Short())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	commits, err := r.Log(&git.LogOptions{
+		From: head.Hash(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	err = commits.ForEach(func(c *object.Commit) error {
+		tags = append(tags, tagsByCommit[c.Hash]...)
+		return nil
+	})
+	// The history of a shallow clone stops short.
+	if err != nil && err != plumbing.ErrObjectNotFound {
+		return nil, err
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// revTime implements revTime for goGitVCS.
+func (goGitVCS) revTime(dir string) (time.Time, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return time.Time{}, err
+	}
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return commit.Committer.When.UTC(), nil
+}
+
+// remoteURL implements remoteURL for goGitVCS.
+func (goGitVCS) remoteURL(dir, name string) (string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return "", err
+	}
+	remote, err := r.Remote(name)
+	if err != nil {
+		return "", err
+	}
+	urls := remote.Config().URLs
+	if len(urls) == 0 {
+		return "", fmt.Errorf("remote %q has no URL", name)
+	}
+	return urls[0], nil
+}
+
+// revTags implements revTags for goGitVCS.
+func (goGitVCS) revTags(dir string) ([]string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	err = forEachCommitRef(r, func(name plumbing.ReferenceName, h plumbing.Hash) {
+		if name.IsTag() && h == head.Hash() {
+			tags = append(tags, name.Short())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// goGitUpdate prints the git command equivalent to an update made by
+// goGitVCS if the -n or -x flag was specified, and reports whether
+// the update should be made.
+func goGitUpdate(dir string, args ...string) bool {
+	if *dryRun || *printCommands {
+		printShellCommand(dir, "git", args)
+	}
+	return !*dryRun
+}
+
+// keepIgnored calls f, which checks out or resets the worktree w of
+// the repository r in dir, keeping any ignored files as git does.
+// Unlike git, go-git removes all the files that aren't in the index,
+// ignored or not, so the ignored files are moved aside while f runs
+// and put back afterwards, except where f has put a file in their place.
+func keepIgnored(r *git.Repository, w *git.Worktree, dir string, f func() error) error {
+	ignored, err := ignoredFiles(r, w, dir)
+	if err != nil {
+		return err
+	}
+	if len(ignored) == 0 {
+		return f()
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Join(dir, git.GitDirName), "gohack-ignored")
+	if err != nil {
+		return err
+	}
+	var moved []string
+	for _, p := range ignored {
+		if err = moveFile(filepath.Join(dir, p), filepath.Join(tmpDir, p)); err != nil {
+			break
+		}
+		moved = append(moved, p)
+	}
+	if err == nil {
+		err = f()
+	}
+	for _, p := range moved {
+		if err := moveFile(filepath.Join(tmpDir, p), filepath.Join(dir, p)); err != nil {
+			return fmt.Errorf("cannot restore ignored files from %s: %v", tmpDir, err)
+		}
+	}
+	os.RemoveAll(tmpDir)
+	return err
+}
+
+// moveFile moves the file or directory from to the path to,
+// creating its parent directory if needed. A directory is merged
+// with any directory already at to, but, as git overwrites ignored
+// files, an existing file at to is left alone.
+func moveFile(from, to string) error {
+	toInfo, err := os.Lstat(to)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+			return err
+		}
+		return os.Rename(from, to)
+	}
+	if err != nil {
+		return err
+	}
+	fromInfo, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	if !fromInfo.IsDir() || !toInfo.IsDir() {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := moveFile(filepath.Join(from, info.Name()), filepath.Join(to, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ignoredFiles returns the slash-separated paths, relative to dir,
+// of the files and directories in the worktree w that are ignored
+// and hold nothing that's in the index of r.
+func ignoredFiles(r *git.Repository, w *git.Worktree, dir string) ([]string, error) {
+	patterns, err := gitignore.ReadPatterns(w.Filesystem, nil)
+	if err != nil {
+		return nil, err
+	}
+	patterns = append(patterns, w.Excludes...)
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	m := gitignore.NewMatcher(patterns)
+	idx, err := r.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	// tracked holds the files in the index and
+	// the directories that hold them.
+	tracked := make(map[string]bool)
+	for _, e := range idx.Entries {
+		for p := e.Name; p != "."; p = path.Dir(p) {
+			tracked[p] = true
+		}
+	}
+	var paths []string
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == git.GitDirName {
+			return filepath.SkipDir
+		}
+		if tracked[rel] || !m.Match(strings.Split(rel, "/"), info.IsDir()) {
+			return nil
+		}
+		paths = append(paths, rel)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// forEachCommitRef calls f for each reference in r that isn't symbolic
+// with the hash of the commit that it refers to. Annotated tags are
+// resolved to their commits and tags of other objects are ignored.
+func forEachCommitRef(r *git.Repository, f func(name plumbing.ReferenceName, h plumbing.Hash)) error {
+	refs, err := r.References()
+	if err != nil {
+		return err
+	}
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		h := ref.Hash()
+		if ref.Name().IsTag() {
+			if tag, err := r.TagObject(h); err == nil {
+				if tag.TargetType != plumbing.CommitObject {
+					return nil
+				}
+				h = tag.Target
+			}
+		}
+		f(ref.Name(), h)
+		return nil
+	})
+}
+
+// revsNotIn returns the ids of the commits that are reachable from any of
+// the starts but not from any of the excludes, like git rev-list starts
+// --not excludes. As git does, it walks the history from newest commit
+// to oldest, stopping once only excluded commits remain, so
+// it doesn't usually need to read all the history.
+func revsNotIn(r *git.Repository, starts, excludes []plumbing.Hash) ([]string, error) {
+	const (
+		fromStart = 1 << iota
+		fromExclude
+	)
+	flags := make(map[plumbing.Hash]int)
+	var q commitQueue
+	add := func(h plumbing.Hash, f int) error {
+		if flags[h]&f == f {
+			return nil
+		}
+		flags[h] |= f
+		c, err := r.CommitObject(h)
+		if err == plumbing.ErrObjectNotFound {
+			// The history is incomplete, perhaps because
+			// the repository is shallow.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		heap.Push(&q, c)
+		return nil
+	}
+	for _, h := range excludes {
+		if err := add(h, fromExclude); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range starts {
+		if err := add(h, fromStart); err != nil {
+			return nil, err
+		}
+	}
+	for q.Len() > 0 && !q.allFlagged(flags, fromExclude) {
+		c := heap.Pop(&q).(*object.Commit)
+		for _, p := range c.ParentHashes {
+			if err := add(p, flags[c.Hash]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var revs []string
+	for h, f := range flags {
+		if f == fromStart {
+			revs = append(revs, h.String())
+		}
+	}
+	sort.Strings(revs)
+	return revs, nil
+}
+
+// commitQueue implements heap.Interface to hold
+// commits in order of descending commit time.
+type commitQueue []*object.Commit
+
+func (q commitQueue) Len() int {
+	return len(q)
+}
+
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].Committer.When.After(q[j].Committer.When)
+}
+
+func (q commitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *commitQueue) Push(x interface{}) {
+	*q = append(*q, x.(*object.Commit))
+}
+
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// allFlagged reports whether all the commits in q
+// have the given flag set.
+func (q commitQueue) allFlagged(flags map[plumbing.Hash]int, flag int) bool {
+	for _, c := range q {
+		if flags[c.Hash]&flag == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// localRepoLoader implements server.Loader to serve
+// the repositories in the local file system, with or
+// without a working tree.
+type localRepoLoader struct{}
+
+func (localRepoLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	dir := ep.Path
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		dir = filepath.Join(dir, ".git")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "config")); err != nil {
+		return nil, transport.ErrRepositoryNotFound
+	}
+	return filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault()), nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
@@ -33,9 +35,16 @@ type listModuleError struct {
 
 // listModules returns information on the given modules as used by the root module.
 func listModules(modules ...string) (mods map[string]*listModule, err error) {
+	return listModulesIn(cwd, modules...)
+}
+
+// listModulesIn is like listModules but runs the go command in
+// the given directory, so that the modules are as used by
+// the main module containing it.
+func listModulesIn(dir string, modules ...string) (mods map[string]*listModule, err error) {
 	// TODO make runCmd return []byte so we don't need the []byte conversion.
 	args := append([]string{"list", "-m", "-json"}, modules...)
-	out, err := runCmd(cwd, "go", args...)
+	out, err := runCmd(dir, "go", args...)
 	if err != nil {
 		return nil, errors.Wrap(err)
 	}
@@ -57,6 +66,49 @@ func listModules(modules ...string) (mods map[string]*listModule, err error) {
 	return mods, nil
 }
 
+// downloadModule downloads the given module version into the
+// module cache and returns information on it. Only the
+// Path, Version, Dir and GoMod fields are filled in.
+func downloadModule(path, version string) (*listModule, error) {
+	return modDownload(nil, path, version)
+}
+
+// cachedModule is like downloadModule except that it only
+// uses modules that are already in the module cache, so
+// it never goes to the network.
+func cachedModule(path, version string) (*listModule, error) {
+	return modDownload([]string{"GOPROXY=off", "GOFLAGS=-mod=mod"}, path, version)
+}
+
+// modDownload runs go mod download for the given module version
+// with the given additions to its environment.
+func modDownload(env []string, path, version string) (*listModule, error) {
+	out, err := runCmdEnv(cwd, env, "go", "mod", "download", "-json", path+"@"+version)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	// Note: go mod download reports errors as a string, unlike go list.
+	var m struct {
+		Path    string
+		Version string
+		Dir     string
+		GoMod   string
+		Error   string
+	}
+	if err := json.Unmarshal([]byte(out), &m); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if m.Error != "" {
+		return nil, errors.New(m.Error)
+	}
+	return &listModule{
+		Path:    m.Path,
+		Version: m.Version,
+		Dir:     m.Dir,
+		GoMod:   m.GoMod,
+	}, nil
+}
+
 // goModInfo returns the main module's root directory
 // and the parsed contents of the go.mod file.
 func goModInfo() (string, *modfile.File, error) {
@@ -65,17 +117,30 @@ func goModInfo() (string, *modfile.File, error) {
 		return "", nil, errors.Notef(err, nil, "cannot find main module")
 	}
 	rootDir := filepath.Dir(goModPath)
-	data, err := ioutil.ReadFile(goModPath)
-	if err != nil {
-		return "", nil, errors.Notef(err, nil, "cannot read main go.mod file")
-	}
-	modf, err := modfile.Parse(goModPath, data, nil)
+	modf, err := readModFile(goModPath)
 	if err != nil {
 		return "", nil, errors.Wrap(err)
 	}
 	return rootDir, modf, nil
 }
 
+// readModFile reads and parses the go.mod file at the given path.
+func readModFile(path string) (*modfile.File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Notef(err, nil, "cannot read go.mod file")
+	}
+	modf, err := modfile.Parse(path, data, nil)
+	if err != nil {
+		if _, err1 := os.Stat(path + backupSuffix); err1 == nil {
+			return nil, errors.Notef(err, nil, "%s is invalid; to restore the copy saved before gohack last changed it, run gohack undo -restore", path)
+		}
+		return nil, errors.Wrap(err)
+	}
+	modFileData[modf] = data
+	return modf, nil
+}
+
 func findGoMod(dir string) (string, error) {
 	out, err := runCmd(dir, "go", "env", "GOMOD")
 	if err != nil {
@@ -88,12 +153,56 @@ func findGoMod(dir string) (string, error) {
 	return strings.TrimSpace(out), nil
 }
 
+// backupSuffix holds the suffix of the backup file written
+// alongside a go.mod or go.work file when gohack changes it.
+const backupSuffix = ".gohack-backup"
+
+// modFileData holds the contents of each parsed go.mod or go.work file
+// as it was when it was read, so that writeModFile can check that it
+// hasn't been changed by something else in the meantime.
+// There is no entry for a file that didn't exist.
+var modFileData = make(map[*modfile.File][]byte)
+
+// writeModFile writes the go.mod or go.work file modf. It fails if
+// the file on disk has changed since it was read, rather than
+// overwriting the changes. The previous contents are saved in a
+// backup file so they can be restored with "gohack undo -restore".
 func writeModFile(modf *modfile.File) error {
 	data, err := modf.Format()
 	if err != nil {
 		return errors.Notef(err, nil, "cannot generate go.mod file")
 	}
-	if err := ioutil.WriteFile(modf.Syntax.Name, data, 0666); err != nil {
+	path := modf.Syntax.Name
+	oldData, ok := modFileData[modf]
+	current, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil && (!ok || !bytes.Equal(current, oldData)):
+		return errors.Newf("%s has been changed by something else since gohack read it; not overwriting it", path)
+	case err != nil && !os.IsNotExist(err):
+		return errors.Wrap(err)
+	case err != nil && ok:
+		return errors.Newf("%s has been removed since gohack read it; not recreating it", path)
+	}
+	if ok {
+		if err := writeFileAtomic(path+backupSuffix, oldData); err != nil {
+			return errors.Notef(err, nil, "cannot write backup file")
+		}
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return errors.Wrap(err)
+	}
+	modFileData[modf] = data
+	return nil
+}
+
+// restoreModFile restores the file at the given path
+// from its backup file.
+func restoreModFile(path string) error {
+	data, err := ioutil.ReadFile(path + backupSuffix)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
 		return errors.Wrap(err)
 	}
 	return nil
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -88,3 +89,43 @@ func copyDir(dst, src string) error {
 	}
 	return nil
 }
+
+// writeFileAtomic writes data to the file with the given path
+// by writing a temporary file in the same directory and renaming
+// it, so the file is never left partially written. The file's
+// permissions are preserved if it already exists.
+func writeFileAtomic(path string, data []byte) (err error) {
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err)
+	}
+	dir, name := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, "."+name+".gohack-tmp")
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return errors.Wrap(err)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrap(err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		return errors.Wrap(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// jsonOutput holds whether the -json flag has been
+// specified for the current command.
+var jsonOutput bool
+
+// addJSONFlag adds the -json flag to the given command.
+func addJSONFlag(cmd *Command) {
+	cmd.Flag.BoolVar(&jsonOutput, "json", false, "print results as JSON")
+}
+
+// failf reports an error for the module with the given status.
+// When printing JSON, the error is recorded in st and printed with
+// it; otherwise it is printed immediately.
+func failf(st *hackStatus, f string, a ...interface{}) {
+	if !jsonOutput {
+		errorf(f, a...)
+		return
+	}
+	st.Error = &listModuleError{
+		Err: fmt.Sprintf(f, a...),
+	}
+	exitCode = 1
+}
+
+// progressf prints an informational message. When printing JSON,
+// the message is printed to stderr so that it doesn't
+// interfere with the JSON output.
+func progressf(f string, a ...interface{}) {
+	if jsonOutput {
+		fmt.Fprintf(os.Stderr, f, a...)
+		return
+	}
+	fmt.Printf(f, a...)
+}
+
+// printJSON prints the given module records to the standard
+// output in the same style as go list -m -json.
+func printJSON(sts []*hackStatus) error {
+	for _, st := range sts {
+		data, err := json.MarshalIndent(st, "", "\t")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		if _, err := os.Stdout.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
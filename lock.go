@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// lockDirName holds the name of the directory inside the gohack
+// directory that holds the lock files. They're kept apart from the
+// directories they lock so that they never end up inside a
+// VCS checkout, and because those directories might not exist yet.
+const lockDirName = ".gohack-locks"
+
+// defaultLockTimeout holds how long to wait for a lock held
+// by another process when $GOHACKLOCKTIMEOUT isn't set.
+const defaultLockTimeout = 5 * time.Minute
+
+// lockPollInterval holds how often to check whether
+// a lock held by another process has been released.
+const lockPollInterval = 100 * time.Millisecond
+
+// lockDir acquires a lock on the hack directory dir that excludes
+// other gohack processes and returns a function that releases it. If another
+// process holds the lock, it waits for it to be released, giving up
+// after the timeout specified by $GOHACKLOCKTIMEOUT.
+//
+// The lock is an advisory lock held by the operating system on
+// a lock file (see lockFile), so it's released when the process
+// holding it exits, however that happens. The lock file holds the
+// pid of the process holding the lock, for use in messages only.
+//
+// Note that this doesn't exclude other goroutines in the same process,
+// which should use their own locking (see lockRepo).
+func lockDir(dir string) (unlock func(), err error) {
+	timeout, err := lockTimeout()
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	path, err := lockFilePath(dir)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	// The lock file is never removed, because another process
+	// might already have opened it to wait for the lock.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	start := time.Now()
+	waiting := false
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, errors.Notef(err, nil, "cannot lock %q", dir)
+		}
+		if ok {
+			break
+		}
+		pid := lockHolder(path)
+		if time.Since(start) > timeout {
+			f.Close()
+			return nil, errors.Newf("timed out waiting for lock on %q held by %s", dir, pidString(pid))
+		}
+		// The holder might not have written its pid yet,
+		// so give it a moment before saying who it is.
+		if !waiting && (pid > 0 || time.Since(start) >= lockPollInterval) {
+			fmt.Fprintf(os.Stderr, "waiting for lock on %s held by %s\n", dir, pidString(pid))
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return func() {
+		// Closing the file releases the lock.
+		f.Close()
+	}, nil
+}
+
+// lockFilePath returns the path of the lock file for the directory dir.
+// Lock files are named after a hash of the directory's absolute path
+// so that directories outside the gohack directory can be locked too.
+// Directories made by the apply command keep their lock files with
+// them, so that every command agrees on where they are.
+func lockFilePath(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	var hackRoot string
+	if mainModFile != nil {
+		if root, _, err := moduleDirIn(applyHackDir, ""); err == nil && isWithinDir(dir, root) {
+			hackRoot = root
+		}
+	}
+	if hackRoot == "" {
+		hackRoot, _, err = moduleDir("")
+		if err != nil {
+			return "", errors.Wrap(err)
+		}
+	}
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(hackRoot, lockDirName, fmt.Sprintf("%x.lock", sum[:12])), nil
+}
+
+// lockTimeout returns the time to wait for a lock
+// as specified by $GOHACKLOCKTIMEOUT.
+func lockTimeout() (time.Duration, error) {
+	s := os.Getenv("GOHACKLOCKTIMEOUT")
+	if s == "" {
+		return defaultLockTimeout, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Newf("invalid $GOHACKLOCKTIMEOUT: %v", err)
+	}
+	return d, nil
+}
+
+// lockHolder returns the pid of the process holding the lock
+// in the given lock file, or 0 if it isn't known.
+func lockHolder(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+func pidString(pid int) string {
+	if pid == 0 {
+		return "unknown process"
+	}
+	return fmt.Sprintf("pid %d", pid)
+}
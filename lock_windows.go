@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// tryLockFile tries to acquire an exclusive lock on f
+// without blocking, and reports whether it succeeded.
+func tryLockFile(f *os.File) (bool, error) {
+	// Lock a byte well beyond the end of the file rather than
+	// its contents, so that other processes can still read
+	// the pid of the process holding the lock.
+	ol := &windows.Overlapped{
+		OffsetHigh: 1,
+	}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -57,7 +57,13 @@ var (
 var commands = []*Command{
 	getCommand,
 	undoCommand,
+	rmCommand,
 	statusCommand,
+	dirCommand,
+	diffCommand,
+	applyCommand,
+	pushCommand,
+	pinCommand,
 }
 
 func main() {
@@ -74,6 +80,7 @@ func main1() int {
 		mainUsage(os.Stderr)
 	}
 	flag.Parse()
+	selectGitVCS()
 	if flag.NArg() == 0 {
 		mainUsage(os.Stderr)
 		return 2
@@ -104,11 +111,27 @@ func main1() int {
 		return 2
 	}
 
+	if cmd == undoCommand && *undoRestore {
+		// This needs to work even when go.mod can't be parsed.
+		if err := cmdUndoRestore(); err != nil {
+			errorf("%v", err)
+		}
+		return exitCode
+	}
+
 	if _, mf, err := goModInfo(); err == nil {
 		mainModFile = mf
 	} else {
 		return errorf("cannot determine main module: %v", err)
 	}
+	if wf, err := goWorkInfo(); err == nil {
+		workFile = wf
+	} else {
+		return errorf("cannot determine workspace: %v", err)
+	}
+	if err := loadMainModules(); err != nil {
+		return errorf("cannot determine main modules: %v", err)
+	}
 
 	rcode := cmd.Run(cmd, cmd.Flag.Args())
 	return max(exitCode, rcode)
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/rogpeppe/go-internal/dirhash"
+	"github.com/rogpeppe/go-internal/modfile"
+	"github.com/rogpeppe/go-internal/module"
 	"golang.org/x/tools/go/vcs"
 	"gopkg.in/errgo.v2/fmt/errors"
 )
@@ -15,9 +20,21 @@ import (
 // gohack hash file in the top level directory, and auto-generated
 // go.mod files.
 func hashDir(dir string, modulePath string) (string, error) {
+	files, err := hackFiles(dir, modulePath)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	return dirhash.Hash1(files, func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, name))
+	})
+}
+
+// hackFiles returns the slash-separated names of all the files
+// in dir that are considered part of the module source by hashDir.
+func hackFiles(dir string, modulePath string) ([]string, error) {
 	files, err := dirhash.DirFiles(dir, "")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	j := 0
 	for _, f := range files {
@@ -26,7 +43,7 @@ func hashDir(dir string, modulePath string) (string, error) {
 		} else if f == "go.mod" {
 			ok, err := isAutoGoMod(filepath.Join(dir, f), modulePath)
 			if err != nil {
-				return "", errors.Wrap(err)
+				return nil, errors.Wrap(err)
 			}
 			if ok {
 				continue
@@ -35,23 +52,85 @@ func hashDir(dir string, modulePath string) (string, error) {
 		files[j] = f
 		j++
 	}
-	files = files[:j]
-	return dirhash.Hash1(files, func(name string) (io.ReadCloser, error) {
-		return os.Open(filepath.Join(dir, name))
-	})
+	return files[:j], nil
+}
+
+// changedFiles returns the names of the files in the hack directory
+// dir that differ from the module source in srcDir, including
+// files that have been added or removed.
+func changedFiles(dir, srcDir string, modulePath string) ([]string, error) {
+	files, err := hackFiles(dir, modulePath)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	srcFiles, err := hackFiles(srcDir, modulePath)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	inSrc := make(map[string]bool)
+	for _, f := range srcFiles {
+		inSrc[f] = true
+	}
+	var changed []string
+	for _, f := range files {
+		if !inSrc[f] {
+			changed = append(changed, f)
+			continue
+		}
+		delete(inSrc, f)
+		same, err := sameContents(filepath.Join(dir, f), filepath.Join(srcDir, f))
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		if !same {
+			changed = append(changed, f)
+		}
+	}
+	for f := range inSrc {
+		changed = append(changed, f)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func sameContents(path1, path2 string) (bool, error) {
+	data1, err := ioutil.ReadFile(path1)
+	if err != nil {
+		return false, errors.Wrap(err)
+	}
+	data2, err := ioutil.ReadFile(path2)
+	if err != nil {
+		return false, errors.Wrap(err)
+	}
+	return bytes.Equal(data1, data2), nil
 }
 
 type moduleVCSInfo struct {
 	// module holds the module information as printed by go list.
 	module *listModule
-	// alreadyExists holds whether the replacement directory already exists.
+	// alreadyExists holds whether the repository root directory already exists.
 	alreadyExists bool
 	// dir holds the absolute path to the replacement directory.
 	dir string
+	// rootDir holds the absolute path to the root of the VCS checkout.
+	// This is the same as dir unless the module is in a subdirectory
+	// of its repository.
+	rootDir string
+	// rootReplDir holds the path to use in the go.mod replace directive
+	// for the root of the VCS checkout.
+	rootReplDir string
+	// subdirs holds the possible slash-separated paths of the module
+	// directory relative to the repository root. See moduleSubdirs.
+	subdirs []string
+	// tagPrefix holds the prefix of version tags for the module.
+	tagPrefix string
 	// replDir holds the path to use for the module in the go.mod replace directive.
 	replDir string
 	// root holds information on the VCS root of the module.
 	root *vcs.RepoRoot
+	// forkRepo holds the URL of the repository to clone instead of
+	// root.Repo, when the module is hacked in a fork.
+	forkRepo string
 	// vcs holds the implementation of the VCS used by the module.
 	vcs VCS
 	// VCSInfo holds information on the VCS tree in the replacement
@@ -60,68 +139,297 @@ type moduleVCSInfo struct {
 }
 
 // getVCSInfoForModule returns VCS information about the module
-// by inspecting the module path and the module's checked out
-// directory.
-func getVCSInfoForModule(m *listModule) (*moduleVCSInfo, error) {
-	// TODO if module directory already exists, could look in it to see if there's
-	// a single VCS directory and use that if so, to avoid hitting the network
-	// for vanity imports.
-	root, err := vcs.RepoRootForImportPath(m.Path, *printCommands)
+// by inspecting the module path. The module is to be checked out
+// in the directory dir; the replDir argument holds the path to use
+// for the module in the go.mod replace directive. Information on any
+// existing checkout is filled out later by readCheckout.
+//
+// When the module lives in a subdirectory of its repository,
+// the repository is checked out in the corresponding parent
+// directory of dir, so modules from the same repository
+// share a single checkout.
+func getVCSInfoForModule(m *listModule, dir, replDir string) (*moduleVCSInfo, error) {
+	root, err := findRepoRoot(m.Path, dir)
 	if err != nil {
-		return nil, errors.Note(err, nil, "cannot find module root")
+		return nil, errors.Wrap(err)
 	}
 	v, ok := kindToVCS[root.VCS.Cmd]
 	if !ok {
 		return nil, errors.Newf("unknown VCS kind %q", root.VCS.Cmd)
 	}
-	dir, replDir, err := moduleDir(m.Path)
+	subdirs, err := moduleSubdirs(m.Path, root.Root)
 	if err != nil {
-		return nil, errors.Notef(err, nil, "failed to determine target directory for %v", m.Path)
-	}
-	dirInfo, err := os.Stat(dir)
-	if err != nil && !os.IsNotExist(err) {
 		return nil, errors.Wrap(err)
 	}
-	if err == nil && !dirInfo.IsDir() {
-		return nil, errors.Newf("%q is not a directory", dir)
+	rootDir, rootReplDir, err := repoRootDir(dir, replDir, subdirs)
+	if err != nil {
+		return nil, errors.Notef(err, nil, "cannot determine root directory of repository %q", root.Root)
 	}
 	info := &moduleVCSInfo{
-		module:        m,
-		root:          root,
-		alreadyExists: err == nil,
-		dir:           dir,
-		replDir:       replDir,
-		vcs:           v,
+		module:      m,
+		root:        root,
+		dir:         dir,
+		rootDir:     rootDir,
+		rootReplDir: rootReplDir,
+		subdirs:     subdirs,
+		replDir:     replDir,
+		vcs:         v,
+	}
+	if codeDir := subdirs[len(subdirs)-1]; codeDir != "" {
+		info.tagPrefix = codeDir + "/"
+	}
+	return info, nil
+}
+
+// vcsHackInfo returns VCS information about the module with the
+// given path, which must currently be replaced by a VCS checkout.
+// As for getVCSInfoForModule, information on the checkout itself
+// is filled out later by readCheckout.
+func vcsHackInfo(mpath string) (*moduleVCSInfo, error) {
+	f, r := findHackReplace(mpath)
+	if r == nil {
+		return nil, errors.Newf("%s is not currently replaced by a directory", mpath)
+	}
+	mods, err := listModules(mpath)
+	if err != nil {
+		return nil, errors.Notef(err, nil, "cannot get module info")
+	}
+	m := mods[mpath]
+	if m == nil {
+		return nil, errors.Newf("module %q not found", mpath)
 	}
+	dir := replaceDirPath(fileDir(f), r.New.Path)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if v, _ := findVCSRoot(dir, mpath); v == nil {
+		return nil, errors.Newf("%q is not a VCS checkout", dir)
+	}
+	return getVCSInfoForModule(m, dir, r.New.Path)
+}
+
+// readCheckout fills out the information on the existing
+// checkout of the repository, if any. Callers should hold
+// the lock on info.rootDir (see lockRepo) so that the
+// checkout cannot change underfoot.
+func (info *moduleVCSInfo) readCheckout() error {
+	dirInfo, err := os.Stat(info.rootDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err)
+	}
+	if err == nil && !dirInfo.IsDir() {
+		return errors.Newf("%q is not a directory", info.rootDir)
+	}
+	info.alreadyExists = err == nil
 	if !info.alreadyExists {
-		return info, nil
+		return nil
+	}
+	info.VCSInfo, err = vcsInfoForDir(info.vcs, info.rootDir, info.dir, info.module.Path)
+	if err != nil {
+		return errors.Wrap(err)
 	}
+	return nil
+}
+
+// findRepoRoot returns information on the repository holding the
+// module with the given path, which is to be checked out in dir.
+//
+// If there's already a checkout in dir, or in a parent directory
+// that could hold the module's repository, that's used without
+// going to the network. Otherwise the mapping in $GOHACKREPOS
+// is consulted (see repoRootFromMap), and if that doesn't
+// mention the module, the import path is resolved in the same
+// way as the go get command does.
+func findRepoRoot(modulePath, dir string) (*vcs.RepoRoot, error) {
+	if v, rootDir := findVCSRoot(dir, modulePath); v != nil {
+		rel, err := filepath.Rel(rootDir, dir)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		// Note: the repository URL isn't needed because
+		// the repository has already been cloned.
+		return &vcs.RepoRoot{
+			VCS:  vcsByCmd(v.Kind()),
+			Root: strings.TrimSuffix(modulePath, "/"+filepath.ToSlash(rel)),
+		}, nil
+	}
+	root, err := repoRootFromMap(modulePath)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if root != nil {
+		return root, nil
+	}
+	root, err = vcs.RepoRootForImportPath(modulePath, *printCommands)
+	if err != nil {
+		return nil, errors.Note(err, nil, "cannot find module root")
+	}
+	return root, nil
+}
+
+// repoRootFromMap returns information on the repository holding the
+// module with the given path as specified by $GOHACKREPOS, or nil
+// if it isn't mentioned there.
+//
+// $GOHACKREPOS holds a comma-separated list of entries of the
+// form prefix=url, each of which specifies that modules with
+// paths that have the given prefix are found in the repository
+// with the given URL. The URL may be prefixed with the
+// kind of VCS and a plus sign (for example hg+https://example.com/repo);
+// otherwise git is assumed. When several prefixes match,
+// the longest is used.
+func repoRootFromMap(modulePath string) (*vcs.RepoRoot, error) {
+	var best *vcs.RepoRoot
+	for _, entry := range strings.Split(os.Getenv("GOHACKREPOS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, errors.Newf("invalid entry %q in $GOHACKREPOS (want prefix=url)", entry)
+		}
+		prefix, url := entry[:i], entry[i+1:]
+		if modulePath != prefix && !strings.HasPrefix(modulePath, prefix+"/") {
+			continue
+		}
+		if best != nil && len(prefix) <= len(best.Root) {
+			continue
+		}
+		kind := "git"
+		if strings.HasPrefix(url, "svn+ssh://") {
+			// That's a Subversion URL scheme in its own right.
+			kind = "svn"
+		} else if j := strings.Index(url, "+"); j > 0 && kindToVCS[url[:j]] != nil {
+			kind, url = url[:j], url[j+1:]
+		}
+		best = &vcs.RepoRoot{
+			VCS:  vcsByCmd(kind),
+			Repo: url,
+			Root: prefix,
+		}
+	}
+	return best, nil
+}
+
+// moduleSubdirs returns the possible slash-separated directories
+// holding the module with the given path relative to the root of
+// the repository with the given import path prefix.
+//
+// The first element holds the directory that corresponds to the module
+// path. When the module path has a major version suffix (for example
+// example.com/foo/v3), the module may instead be found in the directory
+// without the suffix (in this example, at the repository root), so that
+// is returned as a second element. The last element always holds
+// the directory that is used as a prefix for the module's version tags.
+func moduleSubdirs(modulePath, repoPath string) ([]string, error) {
+	if modulePath == repoPath {
+		return []string{""}, nil
+	}
+	if !strings.HasPrefix(modulePath, repoPath+"/") {
+		return nil, errors.Newf("module %q is not inside its repository root %q", modulePath, repoPath)
+	}
+	subdir := modulePath[len(repoPath)+1:]
+	prefix, pathMajor, ok := module.SplitPathVersion(modulePath)
+	if !ok || !strings.HasPrefix(pathMajor, "/") {
+		return []string{subdir}, nil
+	}
+	codeDir := ""
+	if prefix != repoPath {
+		codeDir = prefix[len(repoPath)+1:]
+	}
+	return []string{subdir, codeDir}, nil
+}
+
+// repoRootDir returns the directory holding the root of a repository
+// and the path to use for it in a replace directive, given that dir
+// and replDir hold one of the given repository subdirectories.
+func repoRootDir(dir, replDir string, subdirs []string) (string, string, error) {
+	for _, subdir := range subdirs {
+		if subdir == "" {
+			return dir, replDir, nil
+		}
+		suffix := string(filepath.Separator) + filepath.FromSlash(subdir)
+		if strings.HasSuffix(dir, suffix) && strings.HasSuffix(replDir, suffix) {
+			return strings.TrimSuffix(dir, suffix), strings.TrimSuffix(replDir, suffix), nil
+		}
+	}
+	return "", "", errors.Newf("directory %q does not match the repository layout", dir)
+}
+
+// findModuleDir looks in the VCS checkout for the directory whose go.mod
+// file declares the module and sets info.dir and info.replDir accordingly.
+// If there is no such directory (for example because the module
+// has no go.mod file), it leaves them unchanged.
+func findModuleDir(info *moduleVCSInfo) error {
+	for _, subdir := range info.subdirs {
+		dir, replDir := info.rootDir, info.rootReplDir
+		if subdir != "" {
+			suffix := string(filepath.Separator) + filepath.FromSlash(subdir)
+			dir, replDir = dir+suffix, replDir+suffix
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrap(err)
+		}
+		f, err := modfile.ParseLax(filepath.Join(dir, "go.mod"), data, nil)
+		if err != nil || f.Module == nil || f.Module.Mod.Path != info.module.Path {
+			continue
+		}
+		info.dir, info.replDir = dir, replDir
+		return nil
+	}
+	return nil
+}
+
+// vcsInfoForDir returns information on the VCS tree rooted at rootDir.
+// The dir argument holds the hack directory for the given module path,
+// which may be a subdirectory of rootDir.
+func vcsInfoForDir(v VCS, rootDir, dir string, modulePath string) (VCSInfo, error) {
 	// Remove the go.mod file if it was autogenerated so that the
 	// normal VCS cleanliness detection works OK.
-	removedGoMod, err := removeAutoGoMod(info)
+	removedGoMod, err := removeAutoGoMod(dir, modulePath)
 	if err != nil {
-		return nil, errors.Wrap(err)
+		return VCSInfo{}, errors.Wrap(err)
 	}
-	info.VCSInfo, err = info.vcs.Info(dir)
+	info, err := v.Info(rootDir)
 	if err != nil {
-		return nil, errors.Notef(err, nil, "cannot get VCS info from %q", dir)
+		return VCSInfo{}, errors.Notef(err, nil, "cannot get VCS info from %q", rootDir)
 	}
 	if removedGoMod {
 		// We removed the autogenerated go.mod file so add it back again.
-		if err := ensureGoModFile(info.module.Path, info.dir); err != nil {
-			return nil, errors.Wrap(err)
+		if err := ensureGoModFile(modulePath, dir); err != nil {
+			return VCSInfo{}, errors.Wrap(err)
 		}
 	}
 	return info, nil
 }
 
+// defaultHackDir holds the directory to use in place of $GOHACK
+// when that isn't set, or "" to use $HOME/gohack. The apply command
+// sets it so that the directories it creates are kept with the main
+// module rather than in the user's home directory.
+var defaultHackDir = ""
+
 // moduleDir returns the path to the directory to be used for storing the
 // module with the given path, as well as the filepath to be used in a replace
 // directive. If $GOHACK is set then it will be used. A relative $GOHACK will
 // be interpreted relative to main module directory.
 func moduleDir(module string) (path string, replPath string, err error) {
-	modfp := filepath.FromSlash(module)
 	d := os.Getenv("GOHACK")
+	if d == "" {
+		d = defaultHackDir
+	}
+	return moduleDirIn(d, module)
+}
+
+// moduleDirIn is like moduleDir except that it uses d in
+// place of $GOHACK.
+func moduleDirIn(d, module string) (path string, replPath string, err error) {
+	modfp := filepath.FromSlash(module)
 	if d == "" {
 		uhd, err := UserHomeDir()
 		if err != nil {
@@ -136,17 +444,32 @@ func moduleDir(module string) (path string, replPath string, err error) {
 		return path, path, nil
 	}
 
-	replPath = filepath.Join(d, modfp)
+	mainModDir := filepath.Dir(mainModFile.Syntax.Name)
+	path = filepath.Join(mainModDir, d, modfp)
+
+	// The replace directive is relative to the file it's in,
+	// which might be a go.work file in another directory.
+	replPath, err = relReplacePath(fileDir(hackFile()), path)
+	if err != nil {
+		return "", "", errors.Wrap(err)
+	}
+	return path, replPath, nil
+}
+
+// relReplacePath returns the path of dir relative to fromDir
+// in the form used by a replace directive in a go.mod file
+// in fromDir.
+func relReplacePath(fromDir, dir string) (string, error) {
+	replPath, err := filepath.Rel(fromDir, dir)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
 	if !strings.HasPrefix(replPath, ".."+string(os.PathSeparator)) {
-		// We know replPath is relative, but filepath.Join strips any leading
-		// "./" prefix, and we need that in the replace directive because
-		// otherwise the path will be treated as a module path rather than a
-		// relative file path, so add it back.
+		// We know replPath is relative, but filepath.Rel doesn't
+		// produce any leading "./" prefix, and we need that in the replace
+		// directive because otherwise the path will be treated as a module
+		// path rather than a relative file path, so add it.
 		replPath = "." + string(os.PathSeparator) + replPath
 	}
-
-	mainModDir := filepath.Dir(mainModFile.Syntax.Name)
-	path = filepath.Join(mainModDir, replPath)
-
-	return path, replPath, err
+	return replPath, nil
 }
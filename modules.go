@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rogpeppe/go-internal/modfile"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// mainModFiles holds the go.mod files of all the main modules
+// that the current command operates on. The first element is
+// always mainModFile.
+var mainModFiles []*modfile.File
+
+var (
+	// allModules holds whether the -all-modules flag has been
+	// specified for the current command.
+	allModules bool
+
+	// moduleRoots holds the value of the -modules flag.
+	moduleRoots string
+)
+
+// addModulesFlags adds the -all-modules and -modules
+// flags to the given command.
+func addModulesFlags(cmd *Command) {
+	cmd.Flag.BoolVar(&allModules, "all-modules", false, "operate on all the main modules in the repository")
+	cmd.Flag.StringVar(&moduleRoots, "modules", "", "comma-separated `list` of root directories of other main modules to operate on")
+}
+
+// loadMainModules sets mainModFiles according to the
+// -all-modules and -modules flags.
+func loadMainModules() error {
+	mainModFiles = []*modfile.File{mainModFile}
+	var paths []string
+	switch {
+	case allModules && moduleRoots != "":
+		return errors.New("cannot specify both -all-modules and -modules")
+	case allModules:
+		var err error
+		paths, err = findGoModFiles(repoRoot(fileDir(mainModFile)))
+		if err != nil {
+			return errors.Wrap(err)
+		}
+	case moduleRoots != "":
+		for _, dir := range strings.Split(moduleRoots, ",") {
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(cwd, dir)
+			}
+			paths = append(paths, filepath.Join(dir, "go.mod"))
+		}
+	}
+	seen := map[string]bool{
+		mainModFile.Syntax.Name: true,
+	}
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		f, err := readModFile(path)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		mainModFiles = append(mainModFiles, f)
+	}
+	return nil
+}
+
+// isMainModFile reports whether the go.mod file
+// with the given path is one of mainModFiles.
+func isMainModFile(path string) bool {
+	for _, f := range mainModFiles {
+		if f.Syntax.Name == path {
+			return true
+		}
+	}
+	return false
+}
+
+// holdsMainModule reports whether dir is the directory
+// of a main module or one of its parent directories.
+func holdsMainModule(dir string) bool {
+	for _, f := range append([]*modfile.File{mainModFile}, mainModFiles...) {
+		if f != nil && isWithinDir(fileDir(f), dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// repoRoot returns the root directory of the VCS repository
+// holding dir, or dir itself if it isn't inside a repository.
+func repoRoot(dir string) string {
+	for d := dir; ; {
+		if vcsForDir(d) != nil {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dir
+		}
+		d = parent
+	}
+}
+
+// findGoModFiles returns the paths of all the go.mod files
+// in the directory tree rooted at root, in lexical order.
+// The gohack directory is not searched.
+func findGoModFiles(root string) ([]string, error) {
+	hackRoot, _, err := moduleDir("")
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	var paths []string
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			name := info.Name()
+			if path == hackRoot || path != root && (name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == "go.mod" {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// relPath returns path relative to the current directory
+// if possible, for use in messages.
+func relPath(path string) string {
+	if rel, err := filepath.Rel(cwd, path); err == nil {
+		return rel
+	}
+	return path
+}
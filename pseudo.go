@@ -129,3 +129,24 @@ func parsePseudoVersion(v string) (timestamp, rev string, err error) {
 	}
 	return timestamp, rev, nil
 }
+
+var commitHashRE = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// IsCommitHash reports whether s looks like a full or
+// abbreviated commit hash.
+func IsCommitHash(s string) bool {
+	return commitHashRE.MatchString(s)
+}
+
+// CommitPseudoVersion is like PseudoVersion except that it
+// takes a full or abbreviated commit hash, which it checks
+// and shortens to the usual 12 characters.
+func CommitPseudoVersion(major, older string, t time.Time, hash string) (string, error) {
+	if !IsCommitHash(hash) {
+		return "", fmt.Errorf("malformed commit hash %q", hash)
+	}
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return PseudoVersion(major, older, t, hash), nil
+}
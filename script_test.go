@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"testing"
 
 	"github.com/rogpeppe/go-internal/goproxytest"
@@ -14,10 +15,35 @@ var proxyURL string
 
 func TestMain(m *testing.M) {
 	os.Exit(testscript.RunMain(gohackMain{m}, map[string]func() int{
-		"gohack": main1,
+		"gohack":   main1,
+		"holdlock": holdLock,
 	}))
 }
 
+// holdLock runs a command while holding the gohack lock on
+// a directory, so that tests can exercise lock contention.
+// Usage: holdlock dir command [arg...]
+func holdLock() int {
+	if len(os.Args) < 3 {
+		errorf("usage: holdlock dir command [arg...]")
+		return 2
+	}
+	unlock, err := lockDir(os.Args[1])
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	defer unlock()
+	c := exec.Command(os.Args[2], os.Args[3:]...)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	return 0
+}
+
 type gohackMain struct {
 	m *testing.M
 }
@@ -3,31 +3,363 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/rogpeppe/go-internal/module"
+	"golang.org/x/tools/go/vcs"
 )
 
 var kindToVCS = map[string]VCS{
-	"bzr": bzrVCS{},
-	"hg":  hgVCS{},
-	"git": gitVCS{},
+	"bzr":    bzrVCS{},
+	"hg":     hgVCS{},
+	"git":    gitVCS{},
+	"svn":    svnVCS{},
+	"fossil": fossilVCS{},
+}
+
+// fossilCmd describes the fossil command, which
+// golang.org/x/tools/go/vcs doesn't know about.
+var fossilCmd = &vcs.Cmd{
+	Name: "Fossil",
+	Cmd:  "fossil",
+}
+
+// vcsByCmd is like vcs.ByCmd except that it
+// knows about all the kinds of VCS in kindToVCS.
+func vcsByCmd(cmd string) *vcs.Cmd {
+	if cmd == fossilCmd.Cmd {
+		return fossilCmd
+	}
+	return vcs.ByCmd(cmd)
+}
+
+// vcsForDir returns the VCS implementation used by the
+// checkout in the given directory, or nil if the directory
+// does not contain VCS metadata.
+func vcsForDir(dir string) VCS {
+	for kind, v := range kindToVCS {
+		if _, err := os.Stat(filepath.Join(dir, "."+kind)); err == nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// findVCSRoot looks for the VCS checkout holding the hack directory dir
+// for the module with the given path. As the module may be in a subdirectory
+// of its repository, it looks in the parent directories of dir too,
+// but only as far as the module path allows. It returns the VCS
+// implementation and the root directory of the checkout, or a nil VCS
+// if none was found.
+//
+// Gohack only makes checkouts inside the gohack directory, so it
+// doesn't look outside that, or in any directory holding a main
+// module, where it might find some other repository, such as the
+// main module's own.
+func findVCSRoot(dir string, modulePath string) (VCS, string) {
+	hackRoot, _, err := moduleDir("")
+	if err != nil {
+		return nil, ""
+	}
+	if prefix, pathMajor, ok := module.SplitPathVersion(modulePath); ok && strings.HasPrefix(pathMajor, "/") && filepath.Base(dir) != pathMajor[1:] {
+		// The module lives in the directory without its
+		// major version suffix.
+		modulePath = prefix
+	}
+	elems := strings.Split(modulePath, "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		if dir == hackRoot || !isWithinDir(dir, hackRoot) || holdsMainModule(dir) {
+			break
+		}
+		if v := vcsForDir(dir); v != nil {
+			return v, dir
+		}
+		if filepath.Base(dir) != elems[i] {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil, ""
+}
+
+// upstreamRemote holds the name of the remote that refers
+// to the upstream repository when a module is cloned from a fork.
+const upstreamRemote = "upstream"
+
+// addRemote adds a remote repository with the given name and URL
+// to the checkout in dir and fetches from it, limited by opts
+// as when the checkout was created.
+func addRemote(v VCS, dir, name, url string, opts cloneOptions) error {
+	if g, ok := v.(goGitVCS); ok {
+		return g.addRemote(dir, name, url, opts)
+	}
+	switch v.Kind() {
+	case "git":
+		if opts.depth == 0 && opts.filter == "" {
+			_, err := runUpdateCmd(dir, "git", "remote", "add", "-f", name, url)
+			return err
+		}
+		if _, err := runUpdateCmd(dir, "git", "remote", "add", name, url); err != nil {
+			return err
+		}
+		args := []string{"fetch"}
+		if opts.depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(opts.depth))
+		}
+		if opts.filter != "" {
+			args = append(args, "--filter", opts.filter)
+		}
+		args = append(args, name)
+		_, err := runUpdateCmd(dir, "git", args...)
+		return err
+	case "hg":
+		// Mercurial doesn't have remotes as such, but
+		// a named path serves the same purpose.
+		if !*dryRun {
+			f, err := os.OpenFile(filepath.Join(dir, ".hg", "hgrc"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(f, "\n[paths]\n%s = %s\n", name, url)
+			if err1 := f.Close(); err == nil {
+				err = err1
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := runUpdateCmd(dir, "hg", "pull", name)
+		return err
+	default:
+		return fmt.Errorf("cannot add a remote repository with %s", v.Kind())
+	}
+}
+
+// trackedBranch returns the remote branch tracked by the
+// branch checked out in dir, or "" if there is none.
+func trackedBranch(v VCS, dir string) string {
+	if g, ok := v.(goGitVCS); ok {
+		return g.trackedBranch(dir)
+	}
+	if v.Kind() != "git" {
+		// TODO hg and bzr don't track remote branches in the same
+		// way, but we could report the default path.
+		return ""
+	}
+	out, err := runCmd(dir, "git", "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{upstream}")
+	if err != nil {
+		// There's no tracked branch, or HEAD is detached.
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// currentBranch returns the name of the branch checked
+// out in dir, or "" if there is none. For Mercurial, it
+// returns the active bookmark.
+func currentBranch(v VCS, dir string) string {
+	if g, ok := v.(goGitVCS); ok {
+		return g.currentBranch(dir)
+	}
+	var out string
+	var err error
+	switch v.Kind() {
+	case "git":
+		out, err = runCmd(dir, "git", "symbolic-ref", "--short", "-q", "HEAD")
+	case "hg":
+		out, err = runCmd(dir, "hg", "log", "-r", ".", "--template", "{activebookmark}")
+	default:
+		return ""
+	}
+	if err != nil {
+		// HEAD is detached.
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// remoteURL returns the URL of the git remote with the
+// given name in the checkout in dir.
+func remoteURL(v VCS, dir, name string) (string, error) {
+	if g, ok := v.(goGitVCS); ok {
+		return g.remoteURL(dir, name)
+	}
+	if v.Kind() != "git" {
+		return "", fmt.Errorf("cannot find remotes with %s", v.Kind())
+	}
+	out, err := runCmd(dir, "git", "config", "--get", "remote."+name+".url")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// resolveRevision returns the id of the given revision
+// in the checkout in dir, which must already hold it.
+func resolveRevision(v VCS, dir, rev string) (string, error) {
+	if g, ok := v.(goGitVCS); ok {
+		return g.resolveRevision(dir, rev)
+	}
+	var out string
+	var err error
+	switch v.Kind() {
+	case "git":
+		out, err = runCmd(dir, "git", "rev-parse", "--verify", "-q", rev+"^{commit}")
+	case "hg":
+		out, err = runCmd(dir, "hg", "log", "-r", hgString(rev), "--template", "{node}")
+	default:
+		return "", fmt.Errorf("cannot resolve %s revisions", v.Kind())
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// revTags returns the tags that refer to the currently
+// checked out revision in dir.
+func revTags(v VCS, dir string) ([]string, error) {
+	if g, ok := v.(goGitVCS); ok {
+		return g.revTags(dir)
+	}
+	var out string
+	var err error
+	switch v.Kind() {
+	case "git":
+		out, err = runCmd(dir, "git", "tag", "--points-at", "HEAD")
+	case "hg":
+		out, err = runCmd(dir, "hg", "log", "-r", ".", "--template", "{join(tags, '\\n')}")
+	case "svn":
+		// A Subversion tag is a directory that's
+		// checked out like any other.
+		out, err = runCmd(dir, "svn", "info", "--show-item", "url")
+		if i := strings.LastIndex(out, "/tags/"); err == nil && i >= 0 {
+			return []string{strings.TrimSpace(out[i+len("/tags/"):])}, nil
+		}
+		return nil, err
+	default:
+		// TODO support bzr and fossil.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return statusLines(out), nil
+}
+
+// ancestorTags returns the tags that refer to the currently
+// checked out revision in dir or any of its ancestors.
+func ancestorTags(v VCS, dir string) ([]string, error) {
+	if g, ok := v.(goGitVCS); ok {
+		return g.ancestorTags(dir)
+	}
+	var out string
+	var err error
+	switch v.Kind() {
+	case "git":
+		out, err = runCmd(dir, "git", "tag", "--merged", "HEAD")
+	case "hg":
+		out, err = runCmd(dir, "hg", "log", "-r", "ancestors(.) and tag()", "--template", "{join(tags, '\\n')}\n")
+	default:
+		return nil, fmt.Errorf("cannot find tags with %s", v.Kind())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return statusLines(out), nil
+}
+
+// revTime returns the commit time of the currently
+// checked out revision in dir.
+func revTime(v VCS, dir string) (time.Time, error) {
+	if g, ok := v.(goGitVCS); ok {
+		return g.revTime(dir)
+	}
+	var out string
+	var err error
+	switch v.Kind() {
+	case "git":
+		out, err = runCmd(dir, "git", "log", "-n", "1", "--pretty=format:%ct", "HEAD")
+	case "hg":
+		// The hgdate filter prints the Unix time followed by the
+		// time zone offset.
+		out, err = runCmd(dir, "hg", "log", "-r", ".", "--template", "{date|hgdate}")
+	default:
+		return time.Time{}, fmt.Errorf("cannot find revision time with %s", v.Kind())
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("unexpected %s revision time %q", v.Kind(), out)
+	}
+	unixTime, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected %s revision time %q", v.Kind(), out)
+	}
+	return time.Unix(unixTime, 0).UTC(), nil
 }
 
 type VCS interface {
 	Kind() string
 	Info(dir string) (VCSInfo, error)
-	Update(dir string, isTag bool, revid string) error
+	// Update checks out the given revision. If branch is
+	// non-empty, it names a branch to create or reuse for
+	// the checkout; Update fails rather than moving an existing
+	// branch when that would lose local commits.
+	Update(dir string, isTag bool, revid, branch string) error
 	Clean(dir string) error
-	Create(repo, rootDir string) error
-	Fetch(dir string) error
+	// Create clones the repository into rootDir. VCSs that
+	// can't clone part of a repository ignore opts.
+	Create(repo, rootDir string, opts cloneOptions) error
+	// Fetch fetches new revisions from the remote repositories.
+	// In a partial clone, it fetches at least enough to
+	// check out the given revision, which is a tag if
+	// isTag is true.
+	Fetch(dir string, isTag bool, revid string) error
+}
+
+// cloneOptions holds options that limit how much of
+// a repository is cloned.
+type cloneOptions struct {
+	// depth holds the number of revisions of history
+	// to clone, or zero for all of it.
+	depth int
+	// filter holds a git object filter, such as blob:none,
+	// for a partial clone that fetches objects on demand.
+	filter string
 }
 
 type VCSInfo struct {
 	revid string
 	revno string // optional
+	// clean holds whether there are no local changes
+	// and no unpushed revisions.
 	clean bool
+	// changes holds the VCS status lines describing
+	// any local changes.
+	changes []string
+	// unpushed holds the ids of any revisions that have
+	// not been pushed to a remote repository.
+	unpushed []string
+}
+
+// statusLines splits the output of a VCS status command
+// into its non-empty lines.
+func statusLines(out string) []string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
 }
 
 type gitVCS struct{}
@@ -63,32 +395,179 @@ func (gitVCS) Info(dir string) (VCSInfo, error) {
 	if err != nil {
 		return VCSInfo{}, err
 	}
+	changes := statusLines(out)
+	// Tags are fetched from the remote repository, so
+	// the revisions they refer to have been published
+	// even if no remote branch holds them. The branches
+	// made by Clean only keep revisions that were discarded,
+	// so they don't count.
+	out, err = runCmd(dir, "git", "rev-list", "HEAD", "--exclude="+backupBranchPrefix+"*", "--branches", "--not", "--remotes", "--tags")
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	unpushed := statusLines(out)
 	return VCSInfo{
-		revid: revid,
-		// Empty output (with rc=0) indicates no changes in working copy.
-		clean: out == "",
-		revno: time.Unix(unixTime, 0).UTC().Format(time.RFC3339),
+		revid:    revid,
+		clean:    len(changes) == 0 && len(unpushed) == 0,
+		changes:  changes,
+		unpushed: unpushed,
+		revno:    time.Unix(unixTime, 0).UTC().Format(time.RFC3339),
 	}, nil
 }
 
-func (gitVCS) Create(repo, rootDir string) error {
-	_, err := runUpdateCmd("", "git", "clone", repo, rootDir)
+func (gitVCS) Create(repo, rootDir string, opts cloneOptions) error {
+	_, err := runUpdateCmd("", "git", gitCloneArgs(repo, rootDir, opts)...)
 	return err
 }
 
-func (gitVCS) Update(dir string, isTag bool, revid string) error {
-	_, err := runUpdateCmd(dir, "git", "checkout", revid)
+// gitCloneArgs returns the arguments to git
+// to clone repo into rootDir.
+func gitCloneArgs(repo, rootDir string, opts cloneOptions) []string {
+	args := []string{"clone"}
+	if opts.depth > 0 {
+		// A shallow clone would otherwise include every tag
+		// and the history leading up to it, so leave Fetch to
+		// fetch the tags that are needed.
+		args = append(args, "--depth", strconv.Itoa(opts.depth), "--no-tags")
+	}
+	if opts.filter != "" {
+		// Update checks out the required version, so
+		// don't fetch the files of the default branch.
+		args = append(args, "--filter", opts.filter, "--no-checkout")
+	}
+	return append(args, repo, rootDir)
+}
+
+func (gitVCS) Update(dir string, isTag bool, revid, branch string) error {
+	if branch == "" {
+		_, err := runUpdateCmd(dir, "git", "checkout", revid)
+		return err
+	}
+	out, err := runCmd(dir, "git", "rev-parse", "--verify", "-q", revid+"^{commit}")
+	if err != nil {
+		return err
+	}
+	target := strings.TrimSpace(out)
+	ref := "refs/heads/" + branch
+	if _, err := runCmd(dir, "git", "rev-parse", "--verify", "-q", ref); err == nil {
+		if _, err := runCmd(dir, "git", "merge-base", "--is-ancestor", target, ref); err == nil {
+			// The branch already holds the revision,
+			// perhaps with local commits on top of it.
+			_, err := runUpdateCmd(dir, "git", "checkout", branch)
+			return err
+		}
+		out, err := runCmd(dir, "git", "rev-list", ref, "--not", target, "--remotes")
+		if err != nil {
+			return err
+		}
+		if len(statusLines(out)) > 0 {
+			return fmt.Errorf("branch %q has local commits that are not in %s; not moving it", branch, revid)
+		}
+	}
+	_, err = runUpdateCmd(dir, "git", "checkout", "-B", branch, target)
 	return err
 }
 
 func (gitVCS) Clean(dir string) error {
-	_, err := runUpdateCmd(dir, "git", "reset", "--hard", "HEAD")
+	// Revisions that are only reachable from a detached HEAD
+	// would be lost when another revision is checked out,
+	// so keep them on a branch.
+	if _, err := runCmd(dir, "git", "symbolic-ref", "-q", "HEAD"); err != nil {
+		out, err := runCmd(dir, "git", "rev-list", "HEAD", "--not", "--branches", "--remotes", "--tags")
+		if err != nil {
+			return err
+		}
+		if unpushed := statusLines(out); len(unpushed) > 0 {
+			branch := backupBranch(unpushed[0])
+			if _, err := runUpdateCmd(dir, "git", "branch", "-f", branch, "HEAD"); err != nil {
+				return err
+			}
+			progressf("saved unpushed revisions in branch %s\n", branch)
+		}
+	}
+	if _, err := runUpdateCmd(dir, "git", "reset", "--hard", "HEAD"); err != nil {
+		return err
+	}
+	_, err := runUpdateCmd(dir, "git", "clean", "-f", "-d")
 	return err
 }
 
-func (gitVCS) Fetch(dir string) error {
-	_, err := runCmd(dir, "git", "fetch")
-	return err
+// backupBranchPrefix holds the prefix of the branches that
+// Clean uses to save unpushed revisions.
+const backupBranchPrefix = "gohack-backup/"
+
+// backupBranch returns the name of the branch that Clean uses to
+// save unpushed revisions, the latest of which is revid.
+func backupBranch(revid string) string {
+	if len(revid) > 12 {
+		revid = revid[:12]
+	}
+	return backupBranchPrefix + revid
+}
+
+func (gitVCS) Fetch(dir string, isTag bool, revid string) error {
+	// Fetch from all remotes so that the upstream
+	// repository is included when cloned from a fork.
+	if _, err := runUpdateCmd(dir, "git", "fetch", "--all"); err != nil {
+		return err
+	}
+	if shallow, err := gitIsShallow(dir); err != nil || !shallow {
+		return err
+	}
+	if gitHasRevision(dir, revid) {
+		return nil
+	}
+	if isTag {
+		// A shallow clone only has the tags in its history,
+		// so fetch the tag itself with no more history than
+		// it needs.
+		out, err := runCmd(dir, "git", "remote")
+		if err != nil {
+			return err
+		}
+		for _, remote := range statusLines(out) {
+			if _, err := runUpdateCmd(dir, "git", "fetch", "--depth", "1", remote, "tag", revid); err == nil {
+				return nil
+			}
+		}
+	}
+	// Other revisions can't be fetched by name (the revision
+	// in a pseudo-version is abbreviated), so deepen the
+	// history until it includes the revision.
+	for depth := 100; ; depth *= 2 {
+		if _, err := runUpdateCmd(dir, "git", "fetch", "--all", "--deepen", strconv.Itoa(depth)); err != nil {
+			return err
+		}
+		if *dryRun {
+			// Nothing was fetched, so there's no telling
+			// how far the history would need deepening.
+			return nil
+		}
+		if gitHasRevision(dir, revid) {
+			return nil
+		}
+		if shallow, err := gitIsShallow(dir); err != nil || !shallow {
+			// All the history has been fetched.
+			return err
+		}
+	}
+}
+
+// gitIsShallow reports whether the git repository
+// in dir is a shallow clone.
+func gitIsShallow(dir string) (bool, error) {
+	out, err := runCmd(dir, "git", "rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) == "true", nil
+}
+
+// gitHasRevision reports whether the git repository
+// in dir holds the given commit.
+func gitHasRevision(dir, revid string) bool {
+	_, err := runCmd(dir, "git", "rev-parse", "--verify", "-q", revid+"^{commit}")
+	return err == nil
 }
 
 type bzrVCS struct{}
@@ -114,23 +593,24 @@ func (bzrVCS) Info(dir string) (VCSInfo, error) {
 	if err != nil {
 		return VCSInfo{}, err
 	}
-	clean := true
-	statusLines := strings.Split(out, "\n")
-	for _, line := range statusLines {
-		if line == "" || shelveLine.MatchString(line) {
+	var changes []string
+	for _, line := range statusLines(out) {
+		if shelveLine.MatchString(line) {
 			continue
 		}
-		clean = false
-		break
+		changes = append(changes, line)
 	}
+	// TODO bzr can only tell us about unpushed revisions
+	// by talking to the parent branch.
 	return VCSInfo{
-		revid: m[2],
-		revno: m[1],
-		clean: clean,
+		revid:   m[2],
+		revno:   m[1],
+		clean:   len(changes) == 0,
+		changes: changes,
 	}, nil
 }
 
-func (bzrVCS) Create(repo, rootDir string) error {
+func (bzrVCS) Create(repo, rootDir string, opts cloneOptions) error {
 	_, err := runUpdateCmd("", "bzr", "branch", repo, rootDir)
 	return err
 }
@@ -140,7 +620,9 @@ func (bzrVCS) Clean(dir string) error {
 	return err
 }
 
-func (bzrVCS) Update(dir string, isTag bool, to string) error {
+func (bzrVCS) Update(dir string, isTag bool, to, branch string) error {
+	// Bazaar branches are directories, so there's
+	// no branch to create within the checkout.
 	if isTag {
 		to = "tag:" + to
 	} else {
@@ -150,8 +632,8 @@ func (bzrVCS) Update(dir string, isTag bool, to string) error {
 	return err
 }
 
-func (bzrVCS) Fetch(dir string) error {
-	_, err := runCmd(dir, "bzr", "pull")
+func (bzrVCS) Fetch(dir string, isTag bool, revid string) error {
+	_, err := runUpdateCmd(dir, "bzr", "pull")
 	return err
 }
 
@@ -172,11 +654,21 @@ func (hgVCS) Info(dir string) (VCSInfo, error) {
 	if err != nil {
 		return VCSInfo{}, err
 	}
-	// TODO(rog) check that tree is clean
+	changes := statusLines(out)
+	// Changesets stay in the draft phase until they're pushed,
+	// so we can find outgoing changesets without talking
+	// to the remote repository.
+	out, err = runCmd(dir, "hg", "log", "-r", "draft()", "--template", "{node}\n")
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	unpushed := statusLines(out)
 	return VCSInfo{
-		revid: m[1],
-		revno: m[2],
-		clean: out == "",
+		revid:    m[1],
+		revno:    m[2],
+		clean:    len(changes) == 0 && len(unpushed) == 0,
+		changes:  changes,
+		unpushed: unpushed,
 	}, nil
 }
 
@@ -184,7 +676,7 @@ func (hgVCS) Kind() string {
 	return "hg"
 }
 
-func (hgVCS) Create(repo, rootDir string) error {
+func (hgVCS) Create(repo, rootDir string, opts cloneOptions) error {
 	_, err := runUpdateCmd("", "hg", "clone", "-U", repo, rootDir)
 	return err
 }
@@ -194,13 +686,233 @@ func (hgVCS) Clean(dir string) error {
 	return err
 }
 
-func (hgVCS) Update(dir string, isTag bool, revid string) error {
-	_, err := runUpdateCmd(dir, "hg", "update", revid)
+func (hgVCS) Update(dir string, isTag bool, revid, branch string) error {
+	if branch == "" {
+		_, err := runUpdateCmd(dir, "hg", "update", revid)
+		return err
+	}
+	rev := hgString(revid)
+	bookmark := "bookmark(" + hgString(branch) + ")"
+	// Querying a bookmark that doesn't exist is an error.
+	if _, err := runCmd(dir, "hg", "log", "-r", bookmark, "--template", "{node}"); err == nil {
+		out, err := runCmd(dir, "hg", "log", "-r", rev+" and ancestors("+bookmark+")", "--template", "{node}\n")
+		if err != nil {
+			return err
+		}
+		if len(statusLines(out)) > 0 {
+			// The bookmark already holds the revision,
+			// perhaps with local commits on top of it.
+			_, err := runUpdateCmd(dir, "hg", "update", branch)
+			return err
+		}
+		out, err = runCmd(dir, "hg", "log", "-r", "only("+bookmark+", "+rev+") and draft()", "--template", "{node}\n")
+		if err != nil {
+			return err
+		}
+		if len(statusLines(out)) > 0 {
+			return fmt.Errorf("bookmark %q has local commits that are not in %s; not moving it", branch, revid)
+		}
+	}
+	if _, err := runUpdateCmd(dir, "hg", "update", revid); err != nil {
+		return err
+	}
+	// Setting a bookmark on the working directory's
+	// revision also makes it active.
+	_, err := runUpdateCmd(dir, "hg", "bookmark", "-f", branch)
+	return err
+}
+
+// hgString quotes s as a string in a Mercurial revset.
+func hgString(s string) string {
+	return strconv.Quote(s)
+}
+
+func (hgVCS) Fetch(dir string, isTag bool, revid string) error {
+	_, err := runUpdateCmd(dir, "hg", "pull")
+	return err
+}
+
+// svnVCS implements VCS for Subversion. Tags are expected to be
+// found in the standard layout, as the tags directory alongside
+// the trunk directory.
+type svnVCS struct{}
+
+func (svnVCS) Kind() string {
+	return "svn"
+}
+
+func (svnVCS) Info(dir string) (VCSInfo, error) {
+	out, err := runCmd(dir, "svn", "info", "--show-item", "last-changed-revision")
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	rev, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return VCSInfo{}, fmt.Errorf("svn info has unexpected result %q", out)
+	}
+	out, err = runCmd(dir, "svn", "status")
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	var changes []string
+	for _, line := range statusLines(out) {
+		if strings.HasPrefix(line, "Performing status on external item") {
+			continue
+		}
+		changes = append(changes, line)
+	}
+	// Subversion commits go straight to the server,
+	// so there can't be any unpushed revisions.
+	return VCSInfo{
+		// Pseudo-versions hold the revision number
+		// padded to 12 digits.
+		revid:   fmt.Sprintf("%012d", rev),
+		revno:   strconv.FormatInt(rev, 10),
+		clean:   len(changes) == 0,
+		changes: changes,
+	}, nil
+}
+
+func (svnVCS) Create(repo, rootDir string, opts cloneOptions) error {
+	_, err := runUpdateCmd("", "svn", "checkout", "-q", repo, rootDir)
+	return err
+}
+
+func (svnVCS) Clean(dir string) error {
+	_, err := runUpdateCmd(dir, "svn", "revert", "-q", "-R", ".")
+	return err
+}
+
+func (svnVCS) Update(dir string, isTag bool, revid, branch string) error {
+	// Subversion branches are directories in the repository,
+	// so there's no branch to create within the checkout.
+	trunk, tags, err := svnLayout(dir)
+	if err != nil {
+		return err
+	}
+	if isTag {
+		_, err := runUpdateCmd(dir, "svn", "switch", "-q", tags+"/"+revid)
+		return err
+	}
+	if rev, err := strconv.ParseInt(revid, 10, 64); err == nil {
+		// Remove the padding used in pseudo-versions.
+		revid = strconv.FormatInt(rev, 10)
+	}
+	_, err = runUpdateCmd(dir, "svn", "switch", "-q", trunk+"@"+revid)
+	return err
+}
+
+// svnLayout returns the URLs of the trunk and tags directories
+// of the project checked out in dir. A checkout of a URL that
+// isn't in the standard layout is treated as the trunk.
+func svnLayout(dir string) (trunk, tags string, err error) {
+	out, err := runCmd(dir, "svn", "info", "--show-item", "url")
+	if err != nil {
+		return "", "", err
+	}
+	url := strings.TrimSpace(out)
+	project := ""
+	for _, d := range []string{"/tags/", "/branches/"} {
+		if i := strings.LastIndex(url, d); i >= 0 {
+			project = url[:i]
+			break
+		}
+	}
+	switch {
+	case project != "":
+	case strings.HasSuffix(url, "/trunk"):
+		project = strings.TrimSuffix(url, "/trunk")
+	default:
+		return url, url + "/tags", nil
+	}
+	return project + "/trunk", project + "/tags", nil
+}
+
+func (svnVCS) Fetch(dir string, isTag bool, revid string) error {
+	// A Subversion checkout holds no history, so
+	// there's nothing to fetch; Update talks to
+	// the server directly.
+	return nil
+}
+
+type fossilVCS struct{}
+
+func (fossilVCS) Kind() string {
+	return "fossil"
+}
+
+func (fossilVCS) Info(dir string) (VCSInfo, error) {
+	out, err := runCmd(dir, "fossil", "info")
+	if err != nil {
+		return VCSInfo{}, err
+	}
+	var info VCSInfo
+	for _, line := range statusLines(out) {
+		// The checkout line looks like:
+		//	checkout:     4fe3b7a3f1d2... 2021-02-03 04:05:06 UTC
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "checkout:" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02 15:04:05", fields[2]+" "+fields[3])
+		if err != nil {
+			return VCSInfo{}, fmt.Errorf("fossil info has unexpected checkout time in %q", line)
+		}
+		info.revid = fields[1]
+		// As for git, the commit time serves as the revno.
+		info.revno = t.UTC().Format(time.RFC3339)
+	}
+	if info.revid == "" {
+		return VCSInfo{}, fmt.Errorf("fossil info has unexpected result %q", out)
+	}
+	// Unlike git, fossil changes doesn't report files
+	// that aren't under version control, so ask for
+	// those separately.
+	for _, args := range [][]string{{"changes"}, {"extras"}} {
+		out, err := runCmd(dir, "fossil", args...)
+		if err != nil {
+			return VCSInfo{}, err
+		}
+		info.changes = append(info.changes, statusLines(out)...)
+	}
+	// TODO fossil syncs with the remote repository on commit by
+	// default, but we could still find out about unsent check-ins.
+	info.clean = len(info.changes) == 0
+	return info, nil
+}
+
+func (fossilVCS) Create(repo, rootDir string, opts cloneOptions) error {
+	// A fossil repository is a single file, which we keep
+	// in the checkout directory, as the go command does.
+	if !*dryRun {
+		if err := os.MkdirAll(rootDir, 0777); err != nil {
+			return err
+		}
+	}
+	if _, err := runUpdateCmd("", "fossil", "clone", "--", repo, filepath.Join(rootDir, ".fossil")); err != nil {
+		return err
+	}
+	_, err := runUpdateCmd(rootDir, "fossil", "open", ".fossil")
+	return err
+}
+
+func (fossilVCS) Clean(dir string) error {
+	_, err := runUpdateCmd(dir, "fossil", "revert")
+	return err
+}
+
+func (fossilVCS) Update(dir string, isTag bool, revid, branch string) error {
+	// Fossil branches are shared with the remote repository
+	// when it syncs, so there's no branch to create.
+	if isTag {
+		revid = "tag:" + revid
+	}
+	_, err := runUpdateCmd(dir, "fossil", "update", "--", revid)
 	return err
 }
 
-func (hgVCS) Fetch(dir string) error {
-	_, err := runCmd(dir, "hg", "pull")
+func (fossilVCS) Fetch(dir string, isTag bool, revid string) error {
+	_, err := runUpdateCmd(dir, "fossil", "pull")
 	return err
 }
 
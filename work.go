@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rogpeppe/go-internal/modfile"
+	"github.com/rogpeppe/go-internal/module"
+	"github.com/rogpeppe/go-internal/semver"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// workFile holds the parsed contents of the go.work file
+// in use, or nil if there is none. When gohack get is given the
+// -work flag and there is no go.work file, it holds a new
+// go.work file that will be written when it's changed.
+var workFile *modfile.File
+
+// hackFile returns the file that gohack get adds
+// replace directives to.
+func hackFile() *modfile.File {
+	if *getWork {
+		return workFile
+	}
+	return mainModFile
+}
+
+// replaceFiles returns all the files that can hold replace
+// directives added by gohack: the go.mod files of the main modules
+// and the go.work file, if any.
+func replaceFiles() []*modfile.File {
+	files := append([]*modfile.File(nil), mainModFiles...)
+	if workFile != nil {
+		files = append(files, workFile)
+	}
+	return files
+}
+
+// findHackReplace returns the replace directive that replaces the module
+// with the given path by a directory, and the file holding it.
+// It returns nil if there is no such directive.
+//
+// The go.work file takes precedence because its replacements
+// override those in go.mod files, followed by the main module
+// in the current directory.
+func findHackReplace(mpath string) (*modfile.File, *modfile.Replace) {
+	var files []*modfile.File
+	if workFile != nil {
+		files = append(files, workFile)
+	}
+	for _, f := range append(files, mainModFiles...) {
+		if r := findDirReplace(f, mpath); r != nil {
+			return f, r
+		}
+	}
+	return nil, nil
+}
+
+// fileDir returns the directory holding the given go.mod or go.work file.
+func fileDir(f *modfile.File) string {
+	return filepath.Dir(f.Syntax.Name)
+}
+
+// goWorkInfo returns the parsed contents of the go.work file in use,
+// or nil if there is none.
+func goWorkInfo() (*modfile.File, error) {
+	out, err := runCmd(cwd, "go", "env", "GOWORK")
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	goWorkPath := strings.TrimSpace(out)
+	if goWorkPath == "" || goWorkPath == "off" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(goWorkPath)
+	if err != nil {
+		return nil, errors.Notef(err, nil, "cannot read go.work file")
+	}
+	f, err := parseWorkFile(goWorkPath, data)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	modFileData[f] = data
+	return f, nil
+}
+
+// newWorkFile returns a new go.work file with the given path
+// that uses the main module.
+func newWorkFile(path string) (*modfile.File, error) {
+	// Workspaces were introduced in Go 1.18.
+	goVersion := "1.18"
+	if mainModFile.Go != nil && semver.Compare("v"+mainModFile.Go.Version, "v"+goVersion) > 0 {
+		goVersion = mainModFile.Go.Version
+	}
+	data := "go " + goVersion + "\n\nuse .\n"
+	return parseWorkFile(path, []byte(data))
+}
+
+// parseWorkFile parses the contents of a go.work file.
+// Only the replace directives are interpreted; other directives
+// are left alone in the syntax tree.
+func parseWorkFile(path string, data []byte) (*modfile.File, error) {
+	// The modfile package doesn't know about go.work files,
+	// but the syntax is the same, so parse it leniently, which
+	// ignores the directives it doesn't know about, and then
+	// parse the replace directives ourselves.
+	f, err := modfile.ParseLax(path, data, nil)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	addReplace := func(line *modfile.Line, args []string) error {
+		r, err := parseReplace(args)
+		if err != nil {
+			return errors.Newf("%s:%d: %v", path, line.Start.Line, err)
+		}
+		r.Syntax = line
+		f.Replace = append(f.Replace, r)
+		return nil
+	}
+	for _, stmt := range f.Syntax.Stmt {
+		switch stmt := stmt.(type) {
+		case *modfile.Line:
+			if stmt.Token[0] == "replace" {
+				if err := addReplace(stmt, stmt.Token[1:]); err != nil {
+					return nil, err
+				}
+			}
+		case *modfile.LineBlock:
+			if len(stmt.Token) == 1 && stmt.Token[0] == "replace" {
+				for _, line := range stmt.Line {
+					if err := addReplace(line, line.Token); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	return f, nil
+}
+
+// parseReplace parses the arguments to a replace directive.
+func parseReplace(args []string) (*modfile.Replace, error) {
+	arrow := -1
+	for i, arg := range args {
+		if arg == "=>" {
+			arrow = i
+			break
+		}
+	}
+	if arrow < 1 || arrow > 2 || len(args)-arrow < 2 || len(args)-arrow > 3 {
+		return nil, errors.New("usage: replace module/path [v1.2.3] => other/module v1.4\n\t or replace module/path [v1.2.3] => ../local/directory")
+	}
+	old, err := parseReplaceVersion(args[:arrow])
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	new, err := parseReplaceVersion(args[arrow+1:])
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return &modfile.Replace{
+		Old: old,
+		New: new,
+	}, nil
+}
+
+// parseReplaceVersion parses one side of a replace directive,
+// which holds a path and an optional version.
+func parseReplaceVersion(args []string) (module.Version, error) {
+	var v module.Version
+	path := args[0]
+	if strings.HasPrefix(path, `"`) {
+		p, err := strconv.Unquote(path)
+		if err != nil {
+			return module.Version{}, errors.Newf("invalid quoted string: %v", err)
+		}
+		path = p
+	}
+	v.Path = path
+	if len(args) > 1 {
+		if !semver.IsValid(args[1]) {
+			return module.Version{}, errors.Newf("invalid module version %q", args[1])
+		}
+		v.Version = args[1]
+	}
+	return v, nil
+}